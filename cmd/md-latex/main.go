@@ -1,188 +1,608 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"time"
+
+	"github.com/mknyszek/md-tools/latex"
 )
 
 var (
 	flagIn      = flag.String("i", "", "input file (default: stdin)")
 	flagOut     = flag.String("o", "", "output file (default: stdout)")
-	flagImgDir  = flag.String("img-dir", "", "directory to generate images to (default: PWD)")
+	flagImgDir  = flag.String("img-dir", "", "directory to generate images to, relative to the input file's directory if -i is set (default: PWD)")
+	flagImgSub  = flag.String("img-subdir", "", "generate images to this subdirectory of the output file's directory (default: PWD if writing to stdout)")
+	flagImgCwd  = flag.Bool("img-dir-cwd", false, "resolve a relative -img-dir against PWD even if -i is set")
 	flagCvtPath = flag.String("tex2svg", "", "location of tex2svg utility (default: same directory as binary)")
+	flagFormat  = flag.String("format", "svg", "image format to generate: svg, or png or pdf with rsvg-convert installed")
+	flagDPI     = flag.Int("dpi", 0, "resolution of raster images in dots per inch, e.g. 192 for 2x images; ignored for svg (default: the converter's)")
+	flagSrcset  = flag.Bool("srcset", false, "also generate raster images at twice the resolution, referenced with HTML <img> tags with a srcset")
+	flagPrefix  = flag.String("prefix", "", "prefix for the names and alt text of generated images, to share an image directory between documents")
+	flagMacros  = flag.String("macros", "macros.tex", "name of a file of TeX macros in the input file's directory to load before every equation, if present")
+	flagRewrite = flag.String("rewrite-base", "", "rewrite image references beginning with old to begin with new, given as old=new")
+	flagBg      = flag.String("bg", "", "background of generated images: transparent, white, or another color (default: as generated)")
+	flagCWebP   = flag.String("cwebp", "", "with -format=webp, request PNG images from the converter and convert them with this cwebp utility")
+	flagDelims  = flag.String("inline-delim", "`$...$`", "delimiters of inline equations, given as open...close, e.g. \\(...\\)")
+	flagFigure  = flag.Bool("figure", false, "emit block equations as numbered HTML figures")
+	flagLabel   = flag.String("eqn-label", "", "text/template for block equation labels, with {{.Num}} and {{.Chapter}} (default: \"Equation {{.Num}}\")")
+	flagNumLbl  = flag.Bool("number-labeled", false, "number only the block equations containing a \\label")
+	flagChapter = flag.String("chapter", "", "chapter for use in -eqn-label")
+	flagNative  = flag.Bool("native", false, "rewrite equations into GitHub's native math syntax instead of generating images")
+	flagSprite  = flag.Bool("sprite", false, "pack all images into a single SVG sprite, referenced with <svg> elements; requires -format=svg")
+	flagCenter  = flag.Bool("center", false, "center block equations by wrapping them in <div align=\"center\">")
+	flagDataURI = flag.Bool("inline-data-uri", false, "embed inline equation images in the document as data URIs, rather than generating files")
+	flagVAlign  = flag.String("valign", "", "vertical alignment of inline equations, as a CSS length like -0.3ex, or auto to take it from each SVG image; implies -inline-html")
+	flagInlTmpl = flag.String("inline-template", "", "text/template for the markup of inline equations, with {{.Ref}}, {{.Alt}}, {{.Width}}, and {{.Height}}")
+	flagBlkTmpl = flag.String("block-template", "", "text/template for the markup of block equations, like -inline-template, with {{.Num}}")
+	flagInlHTML = flag.Bool("inline-html", false, "reference inline equation images with HTML <img> tags")
+	flagBlkHTML = flag.Bool("block-html", false, "reference block equation images with HTML <img> tags")
+	flagEscAlt  = flag.Bool("escape-alt", false, "escape characters like _ and * in the alt text of markdown image references")
+	flagEmbed   = flag.Bool("embed-source", false, "emit the source of each equation in a comment next to its image")
+	flagSrcMap  = flag.Bool("sourcemap", false, "emit a comment before each image reference giving the input lines its equation came from")
+	flagKeepTeX = flag.Bool("keep-tex", false, "write the input for each image to a .tex file next to it")
+	flagCwd     = flag.String("cwd", "", "working directory for the converter (default: input file's directory, or PWD)")
+	flagPkgs    = flag.String("packages", "", "comma-separated TeX packages for the converter to load (default: all)")
+	flagMhchem  = flag.Bool("mhchem", false, "ensure the mhchem package is loaded, for \\ce{...}, even with -packages")
+	flagOverwr  = flag.Bool("overwrite", true, "rewrite generated files even if they already exist with the same contents")
+	flagNoICach = flag.Bool("no-inline-cache", false, "generate a new image for every inline equation, even if an identical one was already generated")
+	flagNoBCach = flag.Bool("no-block-cache", false, "generate a new image for every block equation, even if an identical one was already generated")
+	flagCacheDr = flag.String("cache-dir", "", "directory to keep converted images in across runs, reusing them instead of converting their equations again")
+	flagAllowMs = flag.Bool("allow-missing-cache", false, "with -cache-dir, exit successfully even if some equations weren't in the cache and had to be converted")
+	flagWarm    = flag.Bool("warm-cache", false, "only render equations into -cache-dir and the image directory, discarding the output; implies -allow-missing-cache")
+	flagVerify  = flag.Bool("verify-clean", false, "fail if the image directory contains generated images the document doesn't reference")
+	flagStrip   = flag.Bool("strip", false, "restore the equations of a document rendered with -embed-source, replacing their images")
+	flagMaxEq   = flag.Int("max-eq-bytes", 64<<10, "fail if the source of an equation is longer than this many bytes (0 for no limit)")
+	flagSelf    = flag.Bool("selftest", false, "check that the converter works, then exit")
+	flagProg    progressMode
+	flagOutDir  = flag.String("out-dir", "", "directory to write the output for each file argument to, mirroring its path")
+	flagKeepGo  = flag.Bool("keep-going", false, "with file arguments, keep rendering the rest after one fails")
+	flagWatch   = flag.Bool("watch", false, "keep running, rebuilding the output whenever the input or macros file changes (requires -i and -o)")
+	flagV       = flag.Bool("v", false, "log each equation processed to stderr")
+	flagVV      = flag.Bool("vv", false, "like -v, but also log converter invocations and timing")
 )
 
+func init() {
+	flag.Var(&flagProg, "progress", "print a counter of equations rendered to stderr if it's a terminal; -progress=always prints it regardless")
+}
+
+// progressMode is the setting of the -progress flag, which may be
+// given alone, like a boolean flag, or as -progress=always.
+type progressMode string
+
+func (p *progressMode) String() string {
+	return string(*p)
+}
+
+func (p *progressMode) Set(s string) error {
+	switch s {
+	case "true", "always":
+		*p = progressMode(s)
+	case "false":
+		*p = ""
+	default:
+		return fmt.Errorf("unknown progress mode %q", s)
+	}
+	return nil
+}
+
+func (p *progressMode) IsBoolFlag() bool {
+	return true
+}
+
 func main() {
 	flag.Parse()
 
+	if *flagWatch {
+		if err := watch(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if err := run(); err != nil {
-		fmt.Printf("error: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(exitStatus(err))
+	}
+}
+
+// exitStatus returns the status to exit with after run returns err.
+func exitStatus(err error) int {
+	switch err.(type) {
+	case nil:
+		return 0
+	case errCacheMisses:
+		return 2
+	}
+	return 1
+}
+
+// errCacheMisses is returned by run if everything was rendered, but
+// some equations weren't found in -cache-dir, which without
+// -allow-missing-cache makes md-latex exit with status 2.
+type errCacheMisses int
+
+func (n errCacheMisses) Error() string {
+	return fmt.Sprintf("%d equations weren't in the cache", int(n))
+}
+
+// checkCacheMisses returns an errCacheMisses if misses equations
+// weren't found in -cache-dir and that isn't allowed.
+func checkCacheMisses(misses int) error {
+	if misses == 0 || *flagAllowMs || *flagWarm {
+		return nil
 	}
+	return errCacheMisses(misses)
 }
 
 func run() error {
+	if *flagImgDir != "" && *flagImgSub != "" {
+		return fmt.Errorf("-img-dir and -img-subdir are mutually exclusive")
+	}
+	if flag.NArg() != 0 && (*flagIn != "" || *flagOut != "") {
+		return fmt.Errorf("-i and -o can't be used with file arguments")
+	}
+	if flag.NArg() != 0 && *flagOutDir == "" {
+		return fmt.Errorf("file arguments require -out-dir")
+	}
+	if *flagWarm && *flagCacheDr == "" {
+		return fmt.Errorf("-warm-cache requires -cache-dir")
+	}
+	if *flagDataURI && *flagSprite {
+		return fmt.Errorf("-inline-data-uri and -sprite are mutually exclusive")
+	}
+	if *flagSprite && *flagFormat != "svg" && !*flagNative {
+		return fmt.Errorf("-sprite requires -format=svg, not %s", *flagFormat)
+	}
+	if _, err := rewriteBase(); err != nil {
+		return err
+	}
+	if _, err := inlineDelims(); err != nil {
+		return err
+	}
+	if *flagStrip {
+		if flag.NArg() != 0 {
+			return fmt.Errorf("-strip doesn't support file arguments")
+		}
+		return strip(*flagIn, *flagOut)
+	}
+	cvt := &latex.ExecConverter{
+		Path:   *flagCvtPath,
+		Format: *flagFormat,
+		DPI:    *flagDPI,
+		Dir:    *flagCwd,
+	}
+	if *flagFormat == "webp" && *flagCWebP != "" {
+		// Request PNG images to convert with cwebp.
+		cvt.Format = "png"
+	}
+	if *flagPkgs != "" {
+		hasMhchem := false
+		for _, pkg := range strings.Split(*flagPkgs, ",") {
+			pkg = strings.TrimSpace(pkg)
+			hasMhchem = hasMhchem || pkg == "mhchem"
+			cvt.Packages = append(cvt.Packages, pkg)
+		}
+		if *flagMhchem && !hasMhchem {
+			cvt.Packages = append(cvt.Packages, "mhchem")
+		}
+	}
+	var selfTest interface {
+		latex.Converter
+		Check() error
+	} = cvt
+	if *flagFormat == "webp" && *flagCWebP != "" {
+		selfTest = &latex.WebPConverter{Converter: cvt, Path: *flagCWebP}
+	}
+	if !*flagNative || *flagSelf {
+		if err := selfTest.Check(); err != nil {
+			return err
+		}
+	}
+	if *flagSelf {
+		if err := latex.SelfTest(context.Background(), selfTest, *flagFormat); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "converter OK")
+		return nil
+	}
+
+	if *flagCacheDr != "" && !*flagNative {
+		if err := os.MkdirAll(*flagCacheDr, 0o777); err != nil {
+			return err
+		}
+	}
+
+	if flag.NArg() != 0 {
+		misses, err := renderAll(*cvt)
+		if err != nil {
+			return err
+		}
+		return checkCacheMisses(misses)
+	}
+	created := make(map[string]bool)
+	imgDir, misses, err := render(*flagIn, *flagOut, *flagPrefix, *cvt, nil, created)
+	if err != nil {
+		return err
+	}
+	if *flagVerify && !*flagNative {
+		if err := verifyClean(imgDir, *flagPrefix, created); err != nil {
+			return err
+		}
+	}
+	return checkCacheMisses(misses)
+}
+
+// renderAll renders each of the files named by the command line
+// arguments, which may be glob patterns, into -out-dir, sharing
+// images between them where possible. It returns the number of
+// equations that weren't found in -cache-dir.
+func renderAll(cvt latex.ExecConverter) (int, error) {
+	var paths []string
+	for _, arg := range flag.Args() {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return 0, err
+		}
+		if matches == nil {
+			// Let opening it report the error.
+			matches = []string{arg}
+		}
+		paths = append(paths, matches...)
+	}
+
+	type imgSet struct{ dir, prefix string }
+	var imgSets []imgSet
+	cache := latex.NewCache()
+	created := make(map[string]bool)
+	failed := false
+	misses := 0
+	for _, path := range paths {
+		// Mirror the input's relative path in the output directory.
+		rel := filepath.Clean(path)
+		if filepath.IsAbs(rel) || strings.HasPrefix(rel, "..") {
+			rel = filepath.Base(rel)
+		}
+		outPath := filepath.Join(*flagOutDir, rel)
+		// Prefix each document's images by its path, in case they
+		// share an image directory.
+		prefix := strings.Replace(strings.TrimSuffix(rel, filepath.Ext(rel)), string(filepath.Separator), "-", -1)
+		if *flagPrefix != "" {
+			prefix = *flagPrefix + "-" + prefix
+		}
+		var err error
+		if !*flagWarm {
+			err = os.MkdirAll(filepath.Dir(outPath), 0o777)
+		}
+		if err == nil {
+			var imgDir string
+			var n int
+			imgDir, n, err = render(path, outPath, prefix, cvt, cache, created)
+			imgSets = append(imgSets, imgSet{imgDir, prefix})
+			misses += n
+		}
+		if err != nil {
+			if !*flagKeepGo {
+				return 0, fmt.Errorf("%s: %v", path, err)
+			}
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", path, err)
+			failed = true
+		}
+	}
+	if *flagVerify && !*flagNative && !failed {
+		for _, set := range imgSets {
+			if err := verifyClean(set.dir, set.prefix, created); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if failed {
+		return 0, fmt.Errorf("some files failed to render")
+	}
+	return misses, nil
+}
+
+// render renders the document at inPath, or stdin if it's empty, to
+// outPath, or stdout if it's empty, unless -warm-cache discards it,
+// with images named with prefix and
+// generated by cvt. It records the names of the files it creates in
+// created, and returns the directory it generated images in and the
+// number of equations that weren't found in -cache-dir.
+func render(inPath, outPath, prefix string, cvt latex.ExecConverter, cache *latex.Cache, created map[string]bool) (string, int, error) {
+	rewrite, err := rewriteBase()
+	if err != nil {
+		return "", 0, err
+	}
+	delims, err := inlineDelims()
+	if err != nil {
+		return "", 0, err
+	}
+	if cvt.Dir == "" && inPath != "" {
+		cvt.Dir = filepath.Dir(inPath)
+	}
+
 	inFile := os.Stdin
-	outFile := os.Stdout
 
 	var outFileDir string
 	var imgDir string
-	var err error
-	if inPath := *flagIn; inPath != "" {
+	if inPath != "" {
 		inFile, err = os.Open(inPath)
 		if err != nil {
-			return err
+			return "", 0, err
 		}
 		defer inFile.Close()
 	}
 	if imgDir = *flagImgDir; imgDir != "" {
+		if inPath != "" && !*flagImgCwd && !filepath.IsAbs(imgDir) {
+			imgDir = filepath.Join(filepath.Dir(inPath), imgDir)
+		}
 		imgDir, err = filepath.Abs(imgDir)
 		if err != nil {
-			return err
+			return "", 0, err
 		}
 	} else {
 		imgDir, err = os.Getwd()
 		if err != nil {
-			return err
+			return "", 0, err
 		}
 	}
-	if outPath := *flagOut; outPath != "" {
-		outFile, err = os.Create(outPath)
+	if outPath != "" {
+		outFileDir, err = filepath.Abs(filepath.Dir(outPath))
 		if err != nil {
-			return err
+			return "", 0, err
 		}
-		defer outFile.Close()
-		outFileDir, err = filepath.Abs(filepath.Dir(outPath))
+	} else if *flagImgSub != "" {
+		outFileDir, err = os.Getwd()
 		if err != nil {
-			return err
+			return "", 0, err
 		}
 	} else {
 		// So that Rel deeper down doesn't change anything.
 		outFileDir = imgDir
 	}
-	if err := os.MkdirAll(imgDir, 0o777); err != nil {
-		return err
+	if subDir := *flagImgSub; subDir != "" {
+		imgDir = filepath.Join(outFileDir, subDir)
+	}
+	if !*flagNative {
+		if err := os.MkdirAll(imgDir, 0o777); err != nil {
+			return "", 0, err
+		}
 	}
 
 	// Eat up all of the innput.
 	b, err := ioutil.ReadAll(inFile)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 
-	return process(bytes.NewReader(b), outFile, outFileDir, imgDir)
-}
-
-var inlineLatexExp = regexp.MustCompile("`\\$[^\\$]*\\$`")
+	var preamble []byte
+	if macrosPath := macrosPath(inPath); macrosPath != "" && !*flagNative {
+		preamble, err = ioutil.ReadFile(macrosPath)
+		if err != nil && !os.IsNotExist(err) {
+			return "", 0, err
+		}
+	}
 
-func process(in io.Reader, out io.Writer, outFileDir, imgDir string) error {
-	s := bufio.NewScanner(in)
-	consumeEqn := false
-	var mathBuf strings.Builder
-	for s.Scan() {
-		line := s.Text()
-		trimmedLine := strings.TrimSpace(line)
-		if consumeEqn {
-			if trimmedLine == "```" {
-				eqName, outRel, err := createSVG(mathBuf.String(), outFileDir, imgDir, false)
-				if err != nil {
-					return err
-				}
-				fmt.Fprintf(out, "![%s](%s)\n", eqName, outRel)
-				mathBuf.Reset()
-				consumeEqn = false
-			} else {
-				mathBuf.WriteString(line)
-				mathBuf.WriteString("\n")
-			}
-		} else {
-			if trimmedLine == "```render-latex" {
-				consumeEqn = true
-			} else if matches := inlineLatexExp.FindAllStringIndex(line, -1); len(matches) > 0 {
-				var newLine strings.Builder
-				lastIdx := 0
-				for _, rng := range matches {
-					newLine.WriteString(line[lastIdx:rng[0]])
-					eqName, outRel, err := createSVG(line[rng[0]+2:rng[1]-2], outFileDir, imgDir, true)
-					if err != nil {
-						return err
-					}
-					imgRef := fmt.Sprintf("![%s](%s)", eqName, outRel)
-					newLine.WriteString(imgRef)
-					lastIdx = rng[1]
+	opts := latex.Options{
+		ImgDir:           imgDir,
+		OutDir:           outFileDir,
+		Format:           *flagFormat,
+		DPI:              *flagDPI,
+		Srcset:           *flagSrcset,
+		Prefix:           prefix,
+		Preamble:         string(preamble),
+		Background:       *flagBg,
+		RewriteBase:      rewrite,
+		InlineDelims:     delims,
+		Figure:           *flagFigure,
+		EqnLabel:         *flagLabel,
+		NumberLabeled:    *flagNumLbl,
+		Chapter:          *flagChapter,
+		Native:           *flagNative,
+		Sprite:           *flagSprite,
+		Center:           *flagCenter,
+		InlineDataURI:    *flagDataURI,
+		VAlign:           *flagVAlign,
+		InlineTemplate:   *flagInlTmpl,
+		BlockTemplate:    *flagBlkTmpl,
+		InlineHTML:       *flagInlHTML,
+		BlockHTML:        *flagBlkHTML,
+		EscapeAlt:        *flagEscAlt,
+		EmbedSource:      *flagEmbed,
+		SourceMap:        *flagSrcMap,
+		KeepTeX:          *flagKeepTeX,
+		SkipUnchanged:    !*flagOverwr,
+		NoInlineCache:    *flagNoICach,
+		NoBlockCache:     *flagNoBCach,
+		MaxEquationBytes: *flagMaxEq,
+		Cache:            cache,
+		CacheDir:         *flagCacheDr,
+		Log:              os.Stderr,
+	}
+	misses := 0
+	opts.CacheMiss = func(desc string) {
+		misses++
+	}
+	if *flagV {
+		opts.Verbosity = 1
+	}
+	if *flagVV {
+		opts.Verbosity = 2
+		cvt.Log = os.Stderr
+	}
+	opts.Converter = &cvt
+	if *flagCWebP != "" && *flagFormat == "webp" {
+		opts.Converter = &latex.WebPConverter{Converter: &cvt, Path: *flagCWebP}
+	}
+	if isTTY := isTerminal(os.Stderr); !*flagNative && (flagProg == "always" || flagProg == "true" && isTTY) {
+		opts.Progress = func(done, total int) {
+			if isTTY {
+				fmt.Fprintf(os.Stderr, "\r[%d/%d] rendering equations...", done, total)
+				if done == total {
+					fmt.Fprintln(os.Stderr)
 				}
-				newLine.WriteString(line[lastIdx:])
-				fmt.Fprintln(out, newLine.String())
 			} else {
-				fmt.Fprintln(out, line)
+				fmt.Fprintf(os.Stderr, "[%d/%d] rendering equations...\n", done, total)
 			}
 		}
 	}
-	if err := s.Err(); err != nil {
+	opts.Created = func(path string) {
+		created[filepath.Base(path)] = true
+	}
+	// Render the whole output before writing any of it, so that a failure
+	// doesn't leave the output file truncated.
+	var out bytes.Buffer
+	if err := latex.Render(bytes.NewReader(b), &out, opts); err != nil {
+		return "", 0, err
+	}
+	if *flagWarm {
+		return imgDir, misses, nil
+	}
+	if outPath != "" {
+		err = ioutil.WriteFile(outPath, out.Bytes(), 0o666)
+	} else {
+		_, err = os.Stdout.Write(out.Bytes())
+	}
+	return imgDir, misses, err
+}
+
+// strip restores the equations of the document at inPath, or stdin if
+// it's empty, writing the result to outPath, or stdout if it's empty.
+func strip(inPath, outPath string) error {
+	delims, err := inlineDelims()
+	if err != nil {
+		return err
+	}
+	in := os.Stdin
+	if inPath != "" {
+		in, err = os.Open(inPath)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	var out bytes.Buffer
+	if err := latex.Strip(in, &out, latex.Options{InlineDelims: delims}); err != nil {
 		return err
 	}
-	return nil
+	if outPath != "" {
+		return ioutil.WriteFile(outPath, out.Bytes(), 0o666)
+	}
+	_, err = os.Stdout.Write(out.Bytes())
+	return err
 }
 
-var (
-	svgInlineCache = make(map[string]string)
-	svgNumInline   = 1
-	svgNumEqn      = 1
-)
+// rewriteBase parses the -rewrite-base flag.
+func rewriteBase() ([2]string, error) {
+	if *flagRewrite == "" {
+		return [2]string{}, nil
+	}
+	i := strings.IndexByte(*flagRewrite, '=')
+	if i < 0 {
+		return [2]string{}, fmt.Errorf("-rewrite-base must be of the form old=new")
+	}
+	return [2]string{(*flagRewrite)[:i], (*flagRewrite)[i+1:]}, nil
+}
 
-func createSVG(eq, outFileDir, outDir string, inline bool) (string, string, error) {
-	var name, fname string
-	if inline {
-		name = fmt.Sprintf("`%s`", eq)
-		if cached, ok := svgInlineCache[eq]; ok {
-			return name, cached, nil
-		}
-		fname = fmt.Sprintf("inl%d.svg", svgNumInline)
-		svgNumInline++
-	} else {
-		name = fmt.Sprintf("Equation %d", svgNumEqn)
-		fname = fmt.Sprintf("eqn%d.svg", svgNumEqn)
-		svgNumEqn++
+// inlineDelims parses the -inline-delim flag.
+func inlineDelims() ([2]string, error) {
+	i := strings.Index(*flagDelims, "...")
+	if i <= 0 || i+len("...") == len(*flagDelims) {
+		return [2]string{}, fmt.Errorf("-inline-delim must be of the form open...close")
 	}
-	imgOutPath := filepath.Join(outDir, fname)
-	imgOut, err := os.Create(imgOutPath)
-	if err != nil {
-		return "", "", err
+	return [2]string{(*flagDelims)[:i], (*flagDelims)[i+len("..."):]}, nil
+}
+
+// macrosPath returns the path of the -macros file for the input file
+// at inPath, or the empty string if there is none. Standard input has
+// no directory to look for the default macros file in, so it only has
+// one if -macros is set explicitly, relative to PWD.
+func macrosPath(inPath string) string {
+	path := *flagMacros
+	if inPath == "" && !isFlagSet("macros") {
+		return ""
 	}
-	if err := genEqSVG(eq, imgOut, inline); err != nil {
-		imgOut.Close()
-		return "", "", err
+	if path != "" && inPath != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(inPath), path)
 	}
-	imgOut.Close()
-	outRel, err := filepath.Rel(outFileDir, imgOutPath)
-	if err != nil {
-		return "", "", err
+	return path
+}
+
+// isFlagSet reports whether the flag with the given name was set on
+// the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// watchInterval is how often -watch checks for changes.
+const watchInterval = 500 * time.Millisecond
+
+// watch calls run each time the input file or the macros file
+// changes, until the process is interrupted.
+func watch() error {
+	if *flagIn == "" || *flagOut == "" {
+		return fmt.Errorf("-watch requires -i and -o")
 	}
-	if inline {
-		svgInlineCache[eq] = outRel
+	paths := []string{*flagIn}
+	if path := macrosPath(*flagIn); path != "" {
+		paths = append(paths, path)
+	}
+	var last string
+	for {
+		// Summarize the state of the files by their modification
+		// times, treating missing files as unmodified.
+		var state strings.Builder
+		for _, path := range paths {
+			if fi, err := os.Stat(path); err == nil {
+				fmt.Fprintf(&state, "%d %d\n", fi.ModTime().UnixNano(), fi.Size())
+			} else {
+				state.WriteString("-\n")
+			}
+		}
+		if state.String() != last {
+			last = state.String()
+			now := time.Now().Format("15:04:05")
+			if err := run(); err != nil {
+				fmt.Fprintf(os.Stderr, "[%s] error: %v\n", now, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "[%s] rebuilt %s\n", now, *flagOut)
+			}
+		}
+		time.Sleep(watchInterval)
 	}
-	return name, outRel, nil
 }
 
-func genEqSVG(eq string, out io.Writer, inline bool) error {
-	cvtPath := *flagCvtPath
-	if cvtPath == "" {
-		cvtPath = filepath.Join(filepath.Dir(os.Args[0]), "tex2svg")
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// verifyClean checks that every file in imgDir that looks like it was
+// generated by md-latex with the given prefix is in created.
+func verifyClean(imgDir, prefix string, created map[string]bool) error {
+	files, err := ioutil.ReadDir(imgDir)
+	if err != nil {
+		return err
+	}
+	var extra []string
+	for _, fi := range files {
+		if name := fi.Name(); latex.IsGeneratedName(prefix, name) && !created[name] {
+			extra = append(extra, filepath.Join(imgDir, name))
+		}
 	}
-	cmd := exec.Command(
-		*flagCvtPath,
-		fmt.Sprintf("--inline=%t", inline),
-		eq,
-	)
-	cmd.Stdout = out
-	return cmd.Run()
+	if len(extra) != 0 {
+		return fmt.Errorf("unreferenced images in %s:\n\t%s", imgDir, strings.Join(extra, "\n\t"))
+	}
+	return nil
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// stubTeX2SVG is a stand-in for tex2svg that fails to convert any
+// equation containing "fail".
+const stubTeX2SVG = `#!/bin/sh
+for a; do eq=$a; done
+case "$eq" in *fail*) echo "can't convert $eq" >&2; exit 1;; esac
+printf '<svg xmlns="http://www.w3.org/2000/svg"><text>%s</text></svg>' "$eq"
+`
+
+func TestExitStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "md-latex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tex2svg := filepath.Join(dir, "tex2svg")
+	if err := ioutil.WriteFile(tex2svg, []byte(stubTeX2SVG), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := filepath.Join(dir, "cache")
+
+	for _, tt := range []struct {
+		name  string
+		docs  []string
+		allow bool
+		want  int
+	}{
+		{"all missing", []string{"`$x$`\n"}, false, 2},
+		{"all cached", []string{"`$x$`\n"}, false, 0},
+		{"some missing", []string{"`$x$`\n", "`$y$`\n"}, false, 2},
+		{"missing allowed", []string{"`$z$`\n"}, true, 0},
+		{"cached allowed", []string{"`$z$`\n"}, true, 0},
+		{"failed", []string{"`$fail$`\n"}, false, 1},
+		{"failed and missing", []string{"`$fail$`\n", "`$w$`\n"}, false, 1},
+		{"failed and missing allowed", []string{"`$fail$`\n", "`$v$`\n"}, true, 1},
+		{"failed and cached", []string{"`$fail$`\n", "`$x$`\n"}, false, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{
+				"-tex2svg", tex2svg,
+				"-cache-dir", cacheDir,
+				"-allow-missing-cache=" + strconv.FormatBool(tt.allow),
+				"-warm-cache=false",
+				"-img-dir", filepath.Join(dir, "img"),
+				"-out-dir", filepath.Join(dir, "out"),
+				"-keep-going",
+			}
+			for i, doc := range tt.docs {
+				path := filepath.Join(dir, strconv.Itoa(i)+".md")
+				if err := ioutil.WriteFile(path, []byte(doc), 0o666); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, path)
+			}
+			if err := flag.CommandLine.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			err := run()
+			if got := exitStatus(err); got != tt.want {
+				t.Errorf("got exit status %d (error %v), want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunAgain(t *testing.T) {
+	// Like -watch, run twice: the misses of the first run mustn't
+	// count against the second.
+	dir, err := ioutil.TempDir("", "md-latex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tex2svg := filepath.Join(dir, "tex2svg")
+	if err := ioutil.WriteFile(tex2svg, []byte(stubTeX2SVG), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	in, out := filepath.Join(dir, "in.md"), filepath.Join(dir, "out.md")
+	if err := ioutil.WriteFile(in, []byte("`$x$`\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{
+		"-tex2svg", tex2svg,
+		"-cache-dir", filepath.Join(dir, "cache"),
+		"-allow-missing-cache=false",
+		"-warm-cache=false",
+		"-keep-going=false",
+		"-out-dir=",
+		"-img-dir", filepath.Join(dir, "img"),
+		"-i", in,
+		"-o", out,
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := exitStatus(run()), 2; got != want {
+		t.Errorf("first run: got exit status %d, want %d", got, want)
+	}
+	if err := run(); err != nil {
+		t.Errorf("second run: %v", err)
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "md-latex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tex2svg := filepath.Join(dir, "tex2svg")
+	if err := ioutil.WriteFile(tex2svg, []byte(stubTeX2SVG), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	in, out := filepath.Join(dir, "in.md"), filepath.Join(dir, "out.md")
+	if err := ioutil.WriteFile(in, []byte("`$x$`\n\n```render-latex\ny\n```\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := filepath.Join(dir, "cache")
+
+	for _, warm := range []bool{true, false} {
+		args := []string{
+			"-tex2svg", tex2svg,
+			"-cache-dir", cacheDir,
+			"-warm-cache=" + strconv.FormatBool(warm),
+			"-allow-missing-cache=false",
+			"-keep-going=false",
+			"-out-dir=",
+			"-img-dir", filepath.Join(dir, "img"),
+			"-i", in,
+			"-o", out,
+		}
+		if err := flag.CommandLine.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		// Without -allow-missing-cache, rendering after warming
+		// the cache fails if it misses any equations.
+		if err := run(); err != nil {
+			t.Fatalf("-warm-cache=%t: %v", warm, err)
+		}
+		if warm {
+			if fis, err := ioutil.ReadDir(cacheDir); err != nil || len(fis) != 2 {
+				t.Errorf("cache holds %d images (error %v), want 2", len(fis), err)
+			}
+			if _, err := os.Stat(out); !os.IsNotExist(err) {
+				t.Errorf("warming the cache wrote the output")
+			}
+		}
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Errorf("rendering after warming the cache didn't write the output: %v", err)
+	}
+
+	if err := flag.CommandLine.Parse([]string{"-warm-cache", "-cache-dir="}); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(); err == nil {
+		t.Errorf("-warm-cache without -cache-dir succeeded")
+	}
+}
+
+func TestSpriteFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "md-latex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "in.md"), filepath.Join(dir, "out.md")
+	if err := ioutil.WriteFile(in, []byte("`$x$`\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.CommandLine.Parse([]string{"-sprite=false", "-format=svg"})
+	for _, format := range []string{"png", "webp"} {
+		args := []string{
+			"-sprite",
+			"-format", format,
+			"-warm-cache=false",
+			"-tex2svg", filepath.Join(dir, "missing"),
+			"-out-dir=",
+			"-img-dir", filepath.Join(dir, "img"),
+			"-i", in,
+			"-o", out,
+		}
+		if err := flag.CommandLine.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		// The check comes before looking for the converter, let alone
+		// rendering anything.
+		if err := run(); err == nil || !strings.Contains(err.Error(), "-sprite") {
+			t.Errorf("-sprite -format=%s: got error %v, want one about -sprite", format, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "img")); !os.IsNotExist(err) {
+			t.Errorf("-sprite -format=%s created the image directory", format)
+		}
+	}
+}
+
+func TestMacrosPath(t *testing.T) {
+	defer func(fs *flag.FlagSet, macros *string) {
+		flag.CommandLine, flagMacros = fs, macros
+	}(flag.CommandLine, flagMacros)
+	for _, tt := range []struct {
+		args         []string
+		inPath, want string
+	}{
+		{nil, "doc/in.md", filepath.Join("doc", "macros.tex")},
+		{nil, "", ""},
+		{[]string{"-macros=defs.tex"}, "doc/in.md", filepath.Join("doc", "defs.tex")},
+		{[]string{"-macros=defs.tex"}, "", "defs.tex"},
+		{[]string{"-macros="}, "doc/in.md", ""},
+	} {
+		// Parsing doesn't reset flags set before, so start afresh.
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		flagMacros = flag.String("macros", "macros.tex", "")
+		if err := flag.CommandLine.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if got := macrosPath(tt.inPath); got != tt.want {
+			t.Errorf("with %q, macrosPath(%q) = %q, want %q", tt.args, tt.inPath, got, tt.want)
+		}
+	}
+}
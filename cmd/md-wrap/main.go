@@ -2,9 +2,17 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -15,11 +23,12 @@ import (
 // the line is in markdown formatting. It returns this depth and
 // the amount of bytes the quote prefix uses as len. If there is whitespace
 // after the last quote character but before the content begins,
-// then len includes that space.
+// then len includes that space. An escaped quote character (\>) is
+// not counted.
 func countQuoteDepth(line string) (depth, len int) {
 	bytes := 0
 	consumedSpaceAfter := true
-	for _, r := range []rune(line) {
+	for _, r := range line {
 		if unicode.IsSpace(r) {
 			bytes += utf8.RuneLen(r)
 			if !consumedSpaceAfter {
@@ -44,127 +53,1404 @@ const (
 	noList listType = iota
 	numList
 	bulletList
+	defList
 )
 
-func (t listType) symbol() string {
-	switch t {
-	case numList:
-		return "1."
-	case bulletList:
-		return "*"
-	}
-	return ""
-}
-
-func (t listType) runes() int {
-	switch t {
-	case numList:
-		return 2
-	case bulletList:
-		return 1
-	}
-	return 0
-}
-
 // countListIndent looks over a line and returns whether it
 // contains some kind of list, and what the indent of the
 // line is, all encapsulated as a listState. It assumes that
 // the line contains no newlines (\r?\n) and that it contains
-// no markdown quoting.
+// no markdown quoting. An escaped list marker (e.g. \* or 1\.)
+// does not start a list.
 func countListIndent(line string) (l listState) {
-	runes := []rune(line)
-	for i, r := range runes {
+	for i, r := range line {
 		if unicode.IsSpace(r) {
 			l.indent++
 			l.indentBytes += utf8.RuneLen(r)
-		} else if unicode.IsDigit(r) {
-			if len(runes) <= i+2 {
-				return
-			}
-			if runes[i+1] == '.' && unicode.IsSpace(runes[i+2]) {
-				l.typ = numList
-			}
+			continue
+		}
+		marker := listMarker(line[i:])
+		if marker == "" || isThematicBreak(line) {
 			return
-		} else if r == '*' {
+		}
+		l.marker = marker
+		if d := marker[len(marker)-1]; d == '.' || d == ')' {
+			l.typ = numList
+		} else {
 			l.typ = bulletList
-			return
+		}
+		return
+	}
+	return
+}
+
+// listMarker returns the list marker s begins with, such as "*", "-",
+// "10." or "10)", or the empty string if s doesn't begin with a list marker.
+// A list marker must be followed by whitespace or the end of the line.
+func listMarker(s string) string {
+	n := 0
+	switch {
+	case strings.HasPrefix(s, "*") || strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+"):
+		n = 1
+	default:
+		for n < len(s) && n < 9 && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		if n == 0 || n == len(s) || (s[n] != '.' && s[n] != ')') {
+			return ""
+		}
+		n++
+	}
+	if n < len(s) && s[n] != ' ' && s[n] != '\t' {
+		return ""
+	}
+	return s[:n]
+}
+
+// isThematicBreak reports whether line is a thematic break, like
+// "* * *" or "- - -", which is not a list item.
+func isThematicBreak(line string) bool {
+	var mark rune
+	count := 0
+	for _, r := range line {
+		switch {
+		case r == ' ' || r == '\t':
+		case mark == 0 && (r == '*' || r == '-' || r == '_'):
+			mark = r
+			count++
+		case r == mark:
+			count++
+		default:
+			return false
+		}
+	}
+	return count >= 3
+}
+
+// abbreviations are words ending in a period that don't end a sentence.
+var abbreviations = []string{"e.g.", "vs.", "i.e."}
+
+func isAbbreviation(word string) bool {
+	for _, a := range abbreviations {
+		if strings.HasSuffix(word, a) {
+			return true
+		}
+	}
+	return false
+}
+
+func endsSentence(word string) bool {
+	if strings.HasSuffix(word, "\\.") {
+		// An escaped period isn't punctuation.
+		return false
+	}
+	return (strings.HasSuffix(word, ".") ||
+		strings.HasSuffix(word, ".\"") ||
+		strings.HasSuffix(word, ".'")) &&
+		!isAbbreviation(word)
+}
+
+// endsClause reports whether word ends with one of the clause-ending
+// punctuation characters in punct, such as a comma. A trailing
+// abbreviation, as in "e.g.,", doesn't end a clause.
+func endsClause(word, punct string) bool {
+	r, _ := utf8.DecodeLastRuneInString(word)
+	if !strings.ContainsRune(punct, r) || len(word) == utf8.RuneLen(r) {
+		return false
+	}
+	return !isAbbreviation(strings.TrimRight(word, punct))
+}
+
+// spanTracker tracks whether a sequence of words is inside an inline
+// code span or a link, where line breaks are best avoided.
+type spanTracker struct {
+	code     bool
+	brackets int
+	parens   int
+}
+
+func (t *spanTracker) update(word string) {
+	var prev rune
+	for _, r := range word {
+		switch {
+		case r == '`':
+			t.code = !t.code
+		case t.code:
+		case r == '[':
+			t.brackets++
+		case r == ']' && t.brackets > 0:
+			t.brackets--
+		case r == '(' && (prev == ']' || t.parens > 0):
+			t.parens++
+		case r == ')' && t.parens > 0:
+			t.parens--
+		}
+		prev = r
+	}
+}
+
+func (t *spanTracker) inside() bool {
+	return t.code || t.brackets > 0 || t.parens > 0
+}
+
+// inlineTagExp matches the start of an opening or closing inline
+// HTML tag, capturing the slash of a closing tag.
+var inlineTagExp = regexp.MustCompile(`(?i)<(/?)(a|abbr|b|bdi|bdo|cite|code|del|dfn|em|i|ins|kbd|mark|q|s|samp|small|span|strong|sub|sup|time|u|var)\b`)
+
+// inlineTagDepth returns the net number of inline HTML tags opened
+// in s.
+func inlineTagDepth(s string) int {
+	if !strings.Contains(s, "<") {
+		return 0
+	}
+	depth := 0
+	for _, m := range inlineTagExp.FindAllStringSubmatch(s, -1) {
+		if m[1] == "/" {
+			depth--
 		} else {
-			return
+			depth++
+		}
+	}
+	return depth
+}
+
+// imageOpen reports whether s contains the start of a markdown image,
+// like ![alt](url) or ![alt][ref], that isn't closed within s.
+func imageOpen(s string) bool {
+	for {
+		i := strings.Index(s, "![")
+		if i < 0 {
+			return false
+		}
+		s = s[i+1:]
+		end := matchBracket(s, '[', ']')
+		if end < 0 {
+			return true
+		}
+		s = s[end+1:]
+		switch {
+		case strings.HasPrefix(s, "("):
+			end = matchBracket(s, '(', ')')
+		case strings.HasPrefix(s, "["):
+			end = matchBracket(s, '[', ']')
+		default:
+			continue
+		}
+		if end < 0 {
+			return true
+		}
+		s = s[end+1:]
+	}
+}
+
+// commentOpen reports whether s contains the start of an HTML
+// comment that isn't closed within s.
+func commentOpen(s string) bool {
+	i := strings.LastIndex(s, "<!--")
+	return i >= 0 && !strings.Contains(s[i+len("<!--"):], "-->")
+}
+
+// isComment reports whether the unit s is an HTML comment.
+func isComment(s string) bool {
+	return strings.HasPrefix(s, "<!--") && strings.HasSuffix(s, "-->") && len(s) >= len("<!---->")
+}
+
+// matchBracket returns the index of the close bracket matching the
+// open bracket at the start of s, or -1 if there is none.
+func matchBracket(s string, open, close byte) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// isBreakingSpace reports whether r is a space that a line may be
+// broken at. Non-breaking spaces join the words around them into one.
+func isBreakingSpace(r rune) bool {
+	switch r {
+	case '\u00a0', '\u2007', '\u202f':
+		return false
+	}
+	return unicode.IsSpace(r)
+}
+
+// splitWords splits a line into the units that wrapping may place
+// line breaks between. Usually these are just the words of the line,
+// but an inline HTML span like <kbd>Ctrl Alt</kbd>, an image like
+// ![alt text](url), or an HTML comment is kept together as one unit,
+// with its words separated by single spaces.
+func splitWords(line string) []string {
+	words := strings.FieldsFunc(line, isBreakingSpace)
+	units := make([]string, 0, len(words))
+	for i := 0; i < len(words); i++ {
+		j := i
+		unit := words[i]
+		for inlineTagDepth(unit) > 0 || imageOpen(unit) || commentOpen(unit) {
+			if j+1 == len(words) {
+				// The unit doesn't close on this line, so don't
+				// treat it specially.
+				j = i
+				unit = words[i]
+				break
+			}
+			j++
+			unit += " " + words[j]
+		}
+		units = append(units, unit)
+		i = j
+	}
+	return units
+}
+
+type listState struct {
+	typ         listType
+	indent      int
+	indentBytes int
+
+	// marker is the list marker as it appeared in the source,
+	// such as "-", "10." or "10)".
+	marker string
+
+	// symbol is the list marker to emit in the output.
+	symbol string
+}
+
+// numbering is a policy for the numbers of ordered list items.
+type numbering string
+
+const (
+	// lazyNumbering numbers every item with the list's starting
+	// number, which Markdown renders as consecutive numbers.
+	lazyNumbering numbering = "lazy"
+
+	// preserveNumbering keeps each item's number from the source.
+	preserveNumbering numbering = "preserve"
+
+	// renumberNumbering numbers items consecutively from the
+	// list's starting number.
+	renumberNumbering numbering = "renumber"
+)
+
+func (p *numbering) String() string {
+	return string(*p)
+}
+
+func (p *numbering) Set(s string) error {
+	switch v := numbering(s); v {
+	case lazyNumbering, preserveNumbering, renumberNumbering:
+		*p = v
+		return nil
+	}
+	return fmt.Errorf("unknown numbering policy %q", s)
+}
+
+// listCounter tracks the numbers of an ordered list, and the
+// delimiter following them, '.' or ')'.
+type listCounter struct {
+	start, next int
+	delim       byte
+}
+
+// contentIndent returns the indent of the content of the list item
+// in the source, which continuation lines of the item share.
+func (l listState) contentIndent() int {
+	return l.indent + utf8.RuneCountInString(l.marker) + 1
+}
+
+// finalNewline is a policy for the newlines terminating a document.
+type finalNewline string
+
+const (
+	// keepFinalNewline terminates the output with a newline only if
+	// the input was terminated by one.
+	keepFinalNewline finalNewline = "keep"
+
+	// oneFinalNewline terminates the output with exactly one newline.
+	oneFinalNewline finalNewline = "one"
+
+	// noFinalNewline strips all newlines terminating the output.
+	noFinalNewline finalNewline = "none"
+)
+
+func (p *finalNewline) String() string {
+	return string(*p)
+}
+
+func (p *finalNewline) Set(s string) error {
+	switch v := finalNewline(s); v {
+	case keepFinalNewline, oneFinalNewline, noFinalNewline:
+		*p = v
+		return nil
+	}
+	return fmt.Errorf("unknown final newline policy %q", s)
+}
+
+// newlineWriter wraps an io.Writer, holding back any run of trailing
+// newlines so that the newlines terminating the document can be
+// adjusted once all output is written.
+type newlineWriter struct {
+	w       io.Writer
+	pending int
+}
+
+func (n *newlineWriter) Write(b []byte) (int, error) {
+	content := bytes.TrimRight(b, "\n")
+	if len(content) != 0 {
+		if _, err := io.WriteString(n.w, strings.Repeat("\n", n.pending)); err != nil {
+			return 0, err
+		}
+		n.pending = 0
+		if _, err := n.w.Write(content); err != nil {
+			return 0, err
+		}
+	}
+	n.pending += len(b) - len(content)
+	return len(b), nil
+}
+
+// finish writes out count of the held back newlines, or all of them
+// if count is negative.
+func (n *newlineWriter) finish(count int) error {
+	if count < 0 || count > n.pending {
+		count = n.pending
+	}
+	_, err := io.WriteString(n.w, strings.Repeat("\n", count))
+	return err
+}
+
+// lastByteReader wraps an io.Reader and remembers the last byte read.
+type lastByteReader struct {
+	r    io.Reader
+	last byte
+}
+
+func (l *lastByteReader) Read(b []byte) (int, error) {
+	n, err := l.r.Read(b)
+	if n > 0 {
+		l.last = b[n-1]
+	}
+	return n, err
+}
+
+type fmtState struct {
+	charsPerLine     int
+	newLine          strings.Builder
+	newLineRunes     int
+	inCode           bool
+	list             listState
+	appliedFirstList bool
+	listPrefixFirst  string
+	listPrefixRest   string
+	finalNewline     finalNewline
+	out              io.Writer
+
+	// fence is the fence that opened the code block, while inCode
+	// is set for a fenced code block, and codeQuoteDepth is the quote
+	// depth of the fence.
+	fence          string
+	codeQuoteDepth int
+
+	// numbering is the policy for numbering ordered list items,
+	// and counters tracks the ordered lists that are open, keyed
+	// by their indentation.
+	numbering numbering
+	counters  map[int]*listCounter
+
+	// sentenceBreaks starts a new line after the end of each
+	// sentence. Otherwise, sentenceSpacing is the number of spaces
+	// to follow the end of a sentence with.
+	sentenceBreaks  bool
+	sentenceSpacing int
+
+	// clausePunct is the set of punctuation characters after
+	// which a new line is started, in addition to sentence ends.
+	clausePunct string
+	spans       spanTracker
+
+	// expandTabs replaces tabs in the output with spaces, up to
+	// tab stops every tabWidth columns. Tabs in code blocks are
+	// only replaced if expandCodeTabs is also set.
+	expandTabs     bool
+	expandCodeTabs bool
+	tabWidth       int
+
+	// avoidWidows rebalances the last two lines of each paragraph
+	// to avoid leaving a single word on the last line. held is the
+	// line held back for this purpose.
+	avoidWidows bool
+	held        *heldLine
+
+	// balance breaks each run of lines between forced line breaks
+	// so as to minimize raggedness, rather than greedily. run is the
+	// lines of the current run held back for this purpose, and
+	// lineUnits is the units of the line being built.
+	balance   bool
+	run       []runLine
+	lineUnits []string
+
+	// State of the line being built: the length of its quote and
+	// list prefix, the number of words in it, and the offset of
+	// the last of them.
+	prefixBytes   int
+	lineWords     int
+	lastWordStart int
+
+	// hardBreak is set if the line being built ends in a markdown
+	// hard line break, which is kept when it is flushed: a backslash
+	// ending the line stays, or else two spaces are added.
+	hardBreak bool
+
+	// hangingPrefix is the indent of all but the first line of each
+	// paragraph outside of a list. inParagraph is set once the first
+	// line of such a paragraph has begun, and paraIndent is the
+	// indentation of that line, which applies to the whole paragraph.
+	hangingPrefix string
+	inParagraph   bool
+	paraIndent    string
+
+	// stopped is set between stop and start directives, where
+	// lines are emitted verbatim.
+	stopped bool
+
+	// commentOwnLine puts an HTML comment at the end of a line on
+	// a line of its own.
+	commentOwnLine bool
+
+	// table is the rows of the pipe table being read, with their
+	// quote prefixes normalized. wrapTables aligns the columns of
+	// each table, rather than emitting it as is.
+	table      []string
+	wrapTables bool
+
+	// inComment is set within an HTML comment spanning several
+	// lines, which is emitted verbatim.
+	inComment bool
+
+	// inHTMLTable is set within a raw HTML <table>, which is emitted
+	// verbatim, except that wrapHTMLCells wraps the text of each
+	// <td> or <th> cell that is on a line of its own.
+	inHTMLTable   bool
+	wrapHTMLCells bool
+
+	// openedLine is the line on which the last code block, comment,
+	// or HTML table began, for reporting one that is never closed.
+	openedLine int
+
+	// diagOut, if non-nil, receives diagnostics about the input as
+	// JSON lines, naming diagFile if it's set.
+	diagOut  io.Writer
+	diagFile string
+
+	// proseOnly restricts wrapping to top-level paragraphs, passing
+	// all other lines through untouched.
+	proseOnly bool
+
+	// State for prose-only mode. See passThrough. frontMatter is
+	// also set within the front matter in other modes.
+	verbatim    bool
+	frontMatter bool
+	prevBlank   bool
+
+	// maxBlank, if positive, is the most consecutive blank lines
+	// to emit outside of code blocks, and blankRun is the number of
+	// consecutive blank lines just emitted.
+	maxBlank int
+	blankRun int
+
+	// inIndentedCode is set after a line of an indented code block
+	// within a list item.
+	inIndentedCode bool
+
+	// quoteDepth is the quote depth of the last line processed.
+	quoteDepth int
+
+	// defLists recognizes definition lists, whose definitions begin
+	// with ":" and are wrapped with a hanging indent, keeping the
+	// column of the text after the marker.
+	defLists bool
+
+	// listBeforeBlank is the list state in effect before the most
+	// recent blank line, so that an indented paragraph following it
+	// can continue the list item.
+	listBeforeBlank listState
+}
+
+func newFmtState(charsPerLine int, out io.Writer) *fmtState {
+	return &fmtState{
+		charsPerLine:    charsPerLine,
+		finalNewline:    keepFinalNewline,
+		numbering:       lazyNumbering,
+		sentenceBreaks:  true,
+		sentenceSpacing: 1,
+		tabWidth:        4,
+		out:             out,
+	}
+}
+
+// itemSymbol returns the list marker to emit for the list item l,
+// numbering it according to f.numbering.
+func (f *fmtState) itemSymbol(l listState) string {
+	f.closeLists(l.indent + 1)
+	if l.typ != numList {
+		// Keep the bullet of the source, or for definitions, also
+		// the spacing after the marker, which may align the text
+		// of several definitions.
+		delete(f.counters, l.indent)
+		return l.marker
+	}
+	delim := l.marker[len(l.marker)-1]
+	n, _ := strconv.Atoi(l.marker[:len(l.marker)-1])
+	c := f.counters[l.indent]
+	if c == nil || c.delim != delim {
+		// A change of delimiter starts a new list.
+		c = &listCounter{start: n, next: n, delim: delim}
+		f.counters[l.indent] = c
+	}
+	switch f.numbering {
+	case preserveNumbering:
+	case renumberNumbering:
+		n = c.next
+	default:
+		n = c.start
+	}
+	c.next++
+	return strconv.Itoa(n) + string(delim)
+}
+
+// closeLists forgets the numbering of all ordered lists indented by
+// at least indent.
+func (f *fmtState) closeLists(indent int) {
+	for i := range f.counters {
+		if i >= indent {
+			delete(f.counters, i)
+		}
+	}
+}
+
+// flushEmptyItem emits the marker of the current list item alone, if
+// none of its content has been emitted yet. Unless renumbering, the
+// marker is kept as it was in the source, since an empty item has no
+// content to tell it apart from its neighbors by.
+func (f *fmtState) flushEmptyItem() {
+	if f.list.typ != noList && !f.appliedFirstList {
+		marker := f.list.marker
+		if f.numbering == renumberNumbering {
+			marker = f.list.symbol
+		}
+		f.emit(strings.Repeat("> ", f.quoteDepth) + strings.Repeat(" ", f.list.indent) + strings.TrimRight(marker, " "))
+		f.appliedFirstList = true
+	}
+}
+
+// setListState updates the current running list state. If the list
+// item being left had no content of its own, its marker is emitted
+// alone so that the item isn't lost.
+func (f *fmtState) setListState(l listState) {
+	f.flushEmptyItem()
+	f.list = l
+	f.inParagraph = false
+	if l.typ != noList {
+		f.appliedFirstList = false
+		f.listPrefixFirst = strings.Repeat(" ", l.indent) + l.symbol + " "
+		f.listPrefixRest = strings.Repeat(" ", l.indent+utf8.RuneCountInString(l.symbol)+1)
+	} else {
+		f.listPrefixFirst = ""
+		f.listPrefixRest = ""
+	}
+}
+
+func (f *fmtState) writeToLine(s string) {
+	f.newLine.WriteString(s)
+	f.newLineRunes += utf8.RuneCountInString(s)
+}
+
+func (f *fmtState) flushLine() {
+	line := strings.TrimRightFunc(f.newLine.String(), isBreakingSpace)
+	hardBreak := ""
+	if f.hardBreak {
+		if !hasBackslashBreak(line) {
+			hardBreak = "  "
+		}
+		f.hardBreak = false
+	}
+	if len(f.run) != 0 {
+		run := append(f.run, runLine{prefix: line[:f.prefixBytes], units: f.lineUnits})
+		lines := balanceLines(run[0].prefix, run[1].prefix, run, f.charsPerLine, f.space)
+		lines[len(lines)-1] += hardBreak
+		for _, l := range lines {
+			f.emit(l)
+		}
+		f.run = nil
+		f.newLineRunes = 0
+		f.newLine.Reset()
+		return
+	}
+	if f.held != nil {
+		line = f.rebalance(line)
+		f.emit(f.held.text)
+		f.held = nil
+	}
+	f.emit(line + hardBreak)
+	f.newLineRunes = 0
+	f.newLine.Reset()
+}
+
+// hasBackslashBreak reports whether s ends in a backslash that isn't
+// itself escaped, which is a hard line break at the end of a line.
+func hasBackslashBreak(s string) bool {
+	return (len(s)-len(strings.TrimRight(s, `\`)))%2 == 1
+}
+
+// flushCodeLine is like flushLine for a line of an indented code
+// block, whose tabs, like those of fenced code, are only expanded if
+// expandCodeTabs is set.
+func (f *fmtState) flushCodeLine() {
+	inCode := f.inCode
+	f.inCode = true
+	f.flushLine()
+	f.inCode = inCode
+}
+
+// heldLine is a line held back in avoid-widows mode, in case its last
+// word needs to move down to the following line.
+type heldLine struct {
+	text          string
+	lastWordStart int // byte offset of the last word in text
+	words         int // number of words in text
+}
+
+// runLine is a line held back in balance mode, until the run of lines
+// it is part of ends and can be broken again all at once.
+type runLine struct {
+	prefix string
+	units  []string
+}
+
+// balanceLines breaks the units of run into lines of at most width
+// runes, minimizing the raggedness of all but the last line, measured
+// as the sum of the squares of the space left at the end of each. The
+// first line begins with first, and the rest with rest, and each unit
+// is separated from the next on its line by space(unit).
+func balanceLines(first, rest string, run []runLine, width int, space func(string) string) []string {
+	var units []string
+	for _, l := range run {
+		units = append(units, l.units...)
+	}
+	n := len(units)
+
+	// cost[i] is the least cost of breaking units[i:] into lines,
+	// and next[i] is where the line after the one starting with
+	// units[i] starts in doing so.
+	cost := make([]int, n+1)
+	next := make([]int, n+1)
+	for i := n - 1; i >= 0; i-- {
+		prefix := rest
+		if i == 0 {
+			prefix = first
+		}
+		lineLen := utf8.RuneCountInString(prefix)
+		cost[i] = -1
+		for j := i + 1; j <= n; j++ {
+			if j > i+1 {
+				lineLen += len(space(units[j-2]))
+			}
+			lineLen += utf8.RuneCountInString(units[j-1])
+			if lineLen > width && j > i+1 {
+				break
+			}
+			c := cost[j]
+			if slack := width - lineLen; j < n && slack > 0 {
+				c += slack * slack
+			}
+			if cost[i] < 0 || c < cost[i] {
+				cost[i], next[i] = c, j
+			}
+		}
+	}
+
+	var lines []string
+	for i := 0; i < n; i = next[i] {
+		prefix := rest
+		if i == 0 {
+			prefix = first
+		}
+		var line strings.Builder
+		line.WriteString(prefix)
+		for j := i; j < next[i]; j++ {
+			if j > i {
+				line.WriteString(space(units[j-1]))
+			}
+			line.WriteString(units[j])
+		}
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+// space returns the space to follow word with on the same line.
+func (f *fmtState) space(word string) string {
+	if f.sentenceSpacing > 1 && endsSentence(word) {
+		return strings.Repeat(" ", f.sentenceSpacing)
+	}
+	return " "
+}
+
+// wrapLine ends the current line because the next word doesn't fit.
+func (f *fmtState) wrapLine() {
+	if f.balance {
+		f.run = append(f.run, runLine{prefix: f.newLine.String()[:f.prefixBytes], units: f.lineUnits})
+		f.lineUnits = nil
+		f.newLineRunes = 0
+		f.newLine.Reset()
+		return
+	}
+	if !f.avoidWidows {
+		f.flushLine()
+		return
+	}
+	if f.held != nil {
+		f.emit(f.held.text)
+	}
+	f.held = &heldLine{
+		text:          strings.TrimRightFunc(f.newLine.String(), isBreakingSpace),
+		lastWordStart: f.lastWordStart,
+		words:         f.lineWords,
+	}
+	f.newLineRunes = 0
+	f.newLine.Reset()
+}
+
+// rebalance returns line, the last line of a paragraph, after moving
+// the last word of the held line preceding it down, if line would
+// otherwise be a lone word and the result fits.
+func (f *fmtState) rebalance(line string) string {
+	if f.lineWords != 1 || f.held.words < 2 {
+		return line
+	}
+	word := f.held.text[f.held.lastWordStart:]
+	newLine := line[:f.prefixBytes] + word + f.space(word) + line[f.prefixBytes:]
+	if utf8.RuneCountInString(newLine) > f.charsPerLine {
+		return line
+	}
+	f.held.text = strings.TrimRightFunc(f.held.text[:f.held.lastWordStart], isBreakingSpace)
+	return newLine
+}
+
+// emit writes a complete line to the output, expanding tabs if
+// requested.
+func (f *fmtState) emit(line string) {
+	if line != "" || f.inCode || f.stopped {
+		f.blankRun = 0
+	} else if f.blankRun++; f.maxBlank > 0 && f.blankRun > f.maxBlank {
+		return
+	}
+	if f.expandTabs && (!f.inCode || f.expandCodeTabs) {
+		line = expandTabs(line, f.tabWidth)
+	}
+	fmt.Fprintln(f.out, line)
+}
+
+// diagnostic is a problem with the input, reported by -json-diag.
+type diagnostic struct {
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Kind     string `json:"kind"`
+	Message  string `json:"message"`
+}
+
+// diagnose reports a problem of the given kind with the input at the
+// given line and column, if diagnostics are enabled.
+func (f *fmtState) diagnose(line, col int, severity, kind, format string, args ...interface{}) {
+	if f.diagOut == nil {
+		return
+	}
+	// Keep names like "<stdin>" readable.
+	enc := json.NewEncoder(f.diagOut)
+	enc.SetEscapeHTML(false)
+	enc.Encode(diagnostic{
+		File:     f.diagFile,
+		Line:     line,
+		Column:   col,
+		Severity: severity,
+		Kind:     kind,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// expandTabs replaces each tab in line with enough spaces to reach
+// the next tab stop, where tab stops are every width columns.
+func expandTabs(line string, width int) string {
+	if !strings.ContainsRune(line, '\t') {
+		return line
+	}
+	var b strings.Builder
+	col := 0
+	for _, r := range line {
+		if r == '\t' {
+			n := width - col%width
+			b.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
+		b.WriteRune(r)
+		col++
+	}
+	return b.String()
+}
+
+// alertExp matches a GitHub alert marker like [!NOTE], or an Obsidian
+// callout marker like [!tip]- Title, with its fold indicator and
+// title, either of which must be the first line of a blockquote.
+var alertExp = regexp.MustCompile(`^\[![A-Za-z][\w-]*\][+-]?(\s.*)?$`)
+
+var headingExp = regexp.MustCompile(`^#{1,6}(\s|$)`)
+
+// linkDefExp matches a link reference definition, like
+// "[label]: https://example.com", but not a footnote definition.
+var linkDefExp = regexp.MustCompile(`^ {0,3}\[[^\]^][^\]]*\]:(\s|$)`)
+
+// defMarkerExp matches the start of a definition in a definition list,
+// like ":   text", capturing the marker and the spaces following it.
+var defMarkerExp = regexp.MustCompile(`^( {0,3})(: +)\S`)
+
+// definitionItem returns the list state of the definition that line
+// begins, if it does.
+func definitionItem(line string) (l listState, ok bool) {
+	m := defMarkerExp.FindStringSubmatch(line)
+	if m == nil {
+		return listState{}, false
+	}
+	// The marker includes all but one of the spaces after the colon,
+	// so that the text of the definition stays in the same column.
+	return listState{typ: defList, indent: len(m[1]), indentBytes: len(m[1]), marker: m[2][:len(m[2])-1]}, true
+}
+
+// isSetextUnderline reports whether line underlines a setext heading
+// with '='. Underlines made of '-' are thematic breaks.
+func isSetextUnderline(line string) bool {
+	line = strings.TrimSpace(line)
+	return line != "" && strings.Trim(line, "=") == ""
+}
+
+// isIndentedCode reports whether line is indented enough to be part of
+// an indented code block within content indented by indent columns,
+// given that it doesn't continue a paragraph.
+func isIndentedCode(line string, indent int) bool {
+	for i := 0; i < indent; i++ {
+		if line == "" || (line[0] != ' ' && line[0] != '\t') {
+			return false
+		}
+		line = line[1:]
+	}
+	return strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t")
+}
+
+// passThrough reports whether line, the lineNum'th line of the input,
+// should be emitted untouched in prose-only mode. That is, whether it
+// is not part of a top-level paragraph.
+//
+// Front matter and code blocks are passed through, as are headings.
+// Lists, quotes, tables, and HTML are passed through until the next
+// blank line.
+func (f *fmtState) passThrough(lineNum int, line, nextLine string) bool {
+	trimmedLine := strings.TrimSpace(line)
+	prevBlank := f.prevBlank
+	f.prevBlank = len(trimmedLine) == 0
+	switch {
+	case lineNum == 1 && trimmedLine == "---":
+		f.frontMatter = true
+		return true
+	case f.frontMatter:
+		if trimmedLine == "---" || trimmedLine == "..." {
+			f.frontMatter = false
+		}
+		return true
+	case f.isFence(trimmedLine):
+		if !f.inCode {
+			f.openedLine = lineNum
+		}
+		f.inCode = !f.inCode
+		return true
+	case f.inCode:
+		return true
+	case len(trimmedLine) == 0:
+		f.verbatim = false
+		return false
+	case f.verbatim:
+		return true
+	case headingExp.MatchString(line):
+		return true
+	case prevBlank && (strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t")):
+		// Indented code block.
+		f.verbatim = true
+		return true
+	}
+	if _, ok := parseDirective(trimmedLine); ok {
+		return false
+	}
+	if depth, _ := countQuoteDepth(line); depth > 0 ||
+		countListIndent(line).typ != noList ||
+		strings.HasPrefix(trimmedLine, "|") ||
+		isTableHeader(line, nextLine) ||
+		strings.HasPrefix(trimmedLine, "<") {
+		f.verbatim = true
+		return true
+	}
+	return false
+}
+
+var (
+	htmlTagLineExp = regexp.MustCompile(`(?i)^</?(details|summary|div|section|aside|center|figure|figcaption)(\s[^>]*)?>$`)
+	summaryLineExp = regexp.MustCompile(`(?i)^<summary(\s[^>]*)?>.*</summary>$`)
+)
+
+// codeFence returns the fence that line, with its indentation and
+// any quote markers removed, begins with, such as "```" or "~~~~", or
+// the empty string if it doesn't begin with one.
+func codeFence(line string) string {
+	if !strings.HasPrefix(line, "```") && !strings.HasPrefix(line, "~~~") {
+		return ""
+	}
+	n := 0
+	for n < len(line) && line[n] == line[0] {
+		n++
+	}
+	if line[0] == '`' && strings.Contains(line[n:], "`") {
+		// The info string of a backtick fence can't contain backticks.
+		return ""
+	}
+	return line[:n]
+}
+
+// isFence reports whether line, with its indentation and any quote
+// markers removed, opens a fenced code block, or closes the one that
+// is open. A closing fence must be made of the same character as the
+// opening one, be at least as long, and have no info string.
+func (f *fmtState) isFence(line string) bool {
+	fence := codeFence(line)
+	if fence == "" {
+		return false
+	}
+	if !f.inCode {
+		f.fence = fence
+		return true
+	}
+	return fence[0] == f.fence[0] && len(fence) >= len(f.fence) && strings.TrimSpace(line[len(fence):]) == ""
+}
+
+var (
+	htmlTableStartExp = regexp.MustCompile(`(?i)^<table(\s[^>]*)?>`)
+	htmlTableEndExp   = regexp.MustCompile(`(?i)</table>`)
+	htmlCellExp       = regexp.MustCompile(`(?i)^(\s*)(<t[dh](?:\s[^>]*)?>)(.*\S)(</t[dh]>)\s*$`)
+	htmlCellStartExp  = regexp.MustCompile(`(?i)<t[dh][\s>]`)
+)
+
+// wrapCell emits the HTML table cell with the given indentation,
+// opening tag, text, and closing tag, wrapping the text like a
+// paragraph, with the tags attached to its first and last words.
+func (f *fmtState) wrapCell(indent, open, text, close string) {
+	units := splitWords(text)
+	var line strings.Builder
+	line.WriteString(indent + open)
+	lineRunes := utf8.RuneCountInString(line.String())
+	words := 0
+	for i, unit := range units {
+		if i == len(units)-1 {
+			unit += close
+		}
+		n := utf8.RuneCountInString(unit)
+		if words != 0 && lineRunes+1+n > f.charsPerLine {
+			f.emit(line.String())
+			line.Reset()
+			line.WriteString(indent)
+			lineRunes, words = utf8.RuneCountInString(indent), 0
+		}
+		if words != 0 {
+			line.WriteByte(' ')
+			lineRunes++
+		}
+		line.WriteString(unit)
+		lineRunes += n
+		words++
+		if f.sentenceBreaks && endsSentence(unit) && i != len(units)-1 {
+			f.emit(line.String())
+			line.Reset()
+			line.WriteString(indent)
+			lineRunes, words = utf8.RuneCountInString(indent), 0
+		}
+	}
+	f.emit(line.String())
+}
+
+// htmlTableLine emits a line of an HTML table, wrapping the text of a
+// cell on a line of its own if requested, and notes whether the table
+// continues after it.
+func (f *fmtState) htmlTableLine(line string) {
+	f.inHTMLTable = !htmlTableEndExp.MatchString(line)
+	if m := htmlCellExp.FindStringSubmatch(line); m != nil && f.wrapHTMLCells && !htmlCellStartExp.MatchString(m[3]) {
+		f.wrapCell(m[1], m[2], m[3], m[4])
+	} else {
+		f.emit(line)
+	}
+}
+
+// isHTMLTagLine reports whether line consists of just a block-level
+// HTML tag, like <details> or </div>, or a complete <summary> element.
+func isHTMLTagLine(line string) bool {
+	return htmlTagLineExp.MatchString(line) || summaryLineExp.MatchString(line)
+}
+
+// isCommentLine reports whether line consists of just an HTML comment,
+// or the start of one that continues onto following lines.
+func isCommentLine(line string) bool {
+	if !strings.HasPrefix(line, "<!--") {
+		return false
+	}
+	end := strings.Index(line[len("<!--"):], "-->")
+	return end < 0 || len("<!--")+end+len("-->") == len(line)
+}
+
+// isTableRow reports whether line, less any quote prefix, is a row of
+// a pipe table. Outside of a table, only a line starting with a pipe is;
+// within one, so is any other line containing a pipe, since the outer
+// pipes of each row are optional.
+func isTableRow(line string, inTable bool) bool {
+	_, quoteLen := countQuoteDepth(line)
+	line = strings.TrimSpace(line[quoteLen:])
+	if inTable {
+		return line != "" && len(splitCells(line)) > 1 || strings.HasPrefix(line, "|")
+	}
+	return strings.HasPrefix(line, "|")
+}
+
+// delimRowExp matches the delimiter row of a pipe table, like
+// "--- | :-:".
+var delimRowExp = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+
+// isTableHeader reports whether line, less any quote prefix, is the
+// header row of a pipe table, followed by its delimiter row in
+// nextLine, with the same number of cells.
+func isTableHeader(line, nextLine string) bool {
+	_, quoteLen := countQuoteDepth(line)
+	line = strings.TrimSpace(line[quoteLen:])
+	_, quoteLen = countQuoteDepth(nextLine)
+	nextLine = strings.TrimSpace(nextLine[quoteLen:])
+	if !delimRowExp.MatchString(nextLine) {
+		return false
+	}
+	// A line without unescaped pipes followed by "---" is a setext
+	// heading instead.
+	cells := splitCells(line)
+	return (len(cells) > 1 || strings.HasPrefix(line, "|")) && len(cells) == len(splitCells(nextLine))
+}
+
+// flushTable emits the rows of the table that was being read.
+func (f *fmtState) flushTable() {
+	rows := f.table
+	if f.wrapTables {
+		rows = alignTable(rows)
+	}
+	for _, row := range rows {
+		f.emit(row)
+	}
+	f.table = nil
+}
+
+var delimCellExp = regexp.MustCompile(`^:?-+:?$`)
+
+// alignTable returns the rows of a pipe table with the whitespace in
+// each cell collapsed and the cells padded so that the columns line
+// up. If the rows aren't a well-formed table, they are returned as is.
+func alignTable(rows []string) []string {
+	if len(rows) < 2 {
+		return rows
+	}
+	// Every row has the same quote prefix and indentation as the first.
+	_, quoteLen := countQuoteDepth(rows[0])
+	rest := rows[0][quoteLen:]
+	prefix := rows[0][:quoteLen] + rest[:len(rest)-len(strings.TrimLeftFunc(rest, unicode.IsSpace))]
+
+	var cells [][]string
+	var widths []int
+	for _, row := range rows {
+		_, quoteLen := countQuoteDepth(row)
+		rowCells := splitCells(strings.TrimSpace(row[quoteLen:]))
+		for i, cell := range rowCells {
+			if i == len(widths) {
+				widths = append(widths, 3)
+			}
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+		cells = append(cells, rowCells)
+	}
+	for _, cell := range cells[1] {
+		if !delimCellExp.MatchString(cell) {
+			return rows
 		}
 	}
-	return
-}
 
-func endsSentence(word string) bool {
-	return (strings.HasSuffix(word, ".") ||
-		strings.HasSuffix(word, ".\"") ||
-		strings.HasSuffix(word, ".'")) &&
-		!strings.HasSuffix(word, "e.g.") &&
-		!strings.HasSuffix(word, "vs.") &&
-		!strings.HasSuffix(word, "i.e.")
+	aligned := make([]string, 0, len(rows))
+	for r, rowCells := range cells {
+		var b strings.Builder
+		b.WriteString(prefix + "|")
+		for i, width := range widths {
+			var cell string
+			if i < len(rowCells) {
+				cell = rowCells[i]
+			}
+			if r == 1 {
+				// Redraw the delimiter row, keeping its alignment.
+				left, right := "", ""
+				if strings.HasPrefix(cell, ":") {
+					left = ":"
+				}
+				if strings.HasSuffix(cell, ":") && len(cell) > 1 {
+					right = ":"
+				}
+				if cell == "" {
+					cell = "-"
+				}
+				cell = left + strings.Repeat("-", width-len(left)-len(right)) + right
+			}
+			b.WriteString(" " + cell + strings.Repeat(" ", width-utf8.RuneCountInString(cell)) + " |")
+		}
+		aligned = append(aligned, b.String())
+	}
+	return aligned
 }
 
-type listState struct {
-	typ         listType
-	indent      int
-	indentBytes int
+// splitCells splits a row of a pipe table into its cells, with their
+// whitespace collapsed. A pipe escaped with a backslash doesn't
+// separate cells.
+func splitCells(row string) []string {
+	row = strings.TrimPrefix(row, "|")
+	if strings.HasSuffix(row, "|") && !strings.HasSuffix(row, "\\|") {
+		row = row[:len(row)-1]
+	}
+	var cells []string
+	start := 0
+	for i := 0; i < len(row); i++ {
+		switch row[i] {
+		case '\\':
+			i++
+		case '|':
+			cells = append(cells, row[start:i])
+			start = i + 1
+		}
+	}
+	cells = append(cells, row[start:])
+	for i, cell := range cells {
+		cells[i] = strings.Join(strings.FieldsFunc(cell, isBreakingSpace), " ")
+	}
+	return cells
 }
 
-type fmtState struct {
-	charsPerLine     int
-	newLine          strings.Builder
-	newLineRunes     int
-	inCode           bool
-	list             listState
-	appliedFirstList bool
-	listPrefixFirst  string
-	listPrefixRest   string
-	out              io.Writer
-}
+var directiveExp = regexp.MustCompile(`^<!--\s*md-wrap:(.*?)-->\s*(<!--.*-->)?$`)
 
-func newFmtState(charsPerLine int, out io.Writer) *fmtState {
-	return &fmtState{charsPerLine: charsPerLine, out: out}
+// parseDirective checks whether line is an md-wrap directive comment,
+// such as
+//
+//	<!-- md-wrap: width=72 -->
+//	<!-- md-wrap: stop -->
+//
+// and if so, returns the whitespace-separated arguments to it. Only
+// the first comment on the line is a directive; others may follow it.
+func parseDirective(line string) ([]string, bool) {
+	m := directiveExp.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+	return strings.Fields(m[1]), true
 }
 
-// setListState updates the current running list state.
-func (f *fmtState) setListState(l listState) {
-	f.list = l
-	if l.typ != noList {
-		f.appliedFirstList = false
-		f.listPrefixFirst = strings.Repeat(" ", l.indent) + l.typ.symbol() + " "
-		f.listPrefixRest = strings.Repeat(" ", l.indent+l.typ.runes()+1)
-	} else {
-		f.listPrefixFirst = ""
-		f.listPrefixRest = ""
+// applyDirective updates the formatting state according to the
+// arguments of an md-wrap directive. The directive applies from
+// that point in the document forward.
+func (f *fmtState) applyDirective(args []string) error {
+	for _, arg := range args {
+		switch arg {
+		case "stop":
+			f.stopped = true
+			continue
+		case "start":
+			f.stopped = false
+			continue
+		}
+		i := strings.IndexByte(arg, '=')
+		if i < 0 {
+			return fmt.Errorf("malformed md-wrap directive argument %q", arg)
+		}
+		key, value := arg[:i], arg[i+1:]
+		switch key {
+		case "width":
+			width, err := strconv.Atoi(value)
+			if err != nil || width <= 0 {
+				return fmt.Errorf("bad md-wrap width %q", value)
+			}
+			f.charsPerLine = width
+		default:
+			return fmt.Errorf("unknown md-wrap directive argument %q", key)
+		}
 	}
+	return nil
 }
 
-func (f *fmtState) writeToLine(s string) {
-	f.newLine.WriteString(s)
-	f.newLineRunes += len([]rune(s))
+// process wraps the markdown read from in, writing it to f.out. If
+// diagnostics are enabled, it also checks that wrapping is stable,
+// wrapping the output again and reporting the first line, if any, that
+// changes, since such a line may not mean what it did in the input.
+func (f *fmtState) process(in io.Reader) error {
+	if f.diagOut == nil {
+		return f.reflow(in)
+	}
+	again := *f
+	again.diagOut = nil
+	var wrapped, rewrapped bytes.Buffer
+	out := f.out
+	f.out = io.MultiWriter(out, &wrapped)
+	err := f.reflow(in)
+	f.out = out
+	if err != nil {
+		return err
+	}
+	again.out = &rewrapped
+	if err := again.reflow(bytes.NewReader(wrapped.Bytes())); err != nil {
+		return err
+	}
+	if !bytes.Equal(wrapped.Bytes(), rewrapped.Bytes()) {
+		lines := strings.Split(wrapped.String(), "\n")
+		relines := strings.Split(rewrapped.String(), "\n")
+		i := 0
+		for i < len(lines) && i < len(relines) && lines[i] == relines[i] {
+			i++
+		}
+		f.diagnose(i+1, 1, "warning", "unstable", "wrapping the output again changes its line %d", i+1)
+	}
+	return nil
 }
 
-func (f *fmtState) flushLine() {
-	fmt.Fprintln(f.out, strings.TrimRightFunc(f.newLine.String(), unicode.IsSpace))
-	f.newLineRunes = 0
-	f.newLine.Reset()
-}
+// reflow implements process.
+func (f *fmtState) reflow(in io.Reader) error {
+	lr := &lastByteReader{r: in}
+	nw := &newlineWriter{w: f.out}
+	out := f.out
+	f.out = nw
+	defer func() { f.out = out }()
 
-func (f *fmtState) process(in io.Reader) {
-	s := bufio.NewScanner(os.Stdin)
-	for s.Scan() {
+	s := bufio.NewScanner(lr)
+	lineNum := 0
+	f.prevBlank = true
+	f.blankRun = 0
+	f.counters = make(map[int]*listCounter)
+	// Read a line ahead, to recognize the header row of a table
+	// without outer pipes by the delimiter row following it.
+	more := s.Scan()
+	for more {
+		lineNum++
 		line := s.Text()
+		nextLine := ""
+		if more = s.Scan(); more {
+			nextLine = s.Text()
+		}
+		rawLine := line
 		trimmedLine := strings.TrimSpace(line)
-		if strings.HasPrefix(trimmedLine, "```") {
+		if len(f.table) != 0 && !isTableRow(line, true) {
+			f.flushTable()
+		}
+		if f.stopped {
+			// Emit everything verbatim until a start directive.
+			if args, ok := parseDirective(trimmedLine); ok {
+				if err := f.applyDirective(args); err != nil {
+					return fmt.Errorf("line %d: %v", lineNum, err)
+				}
+			}
+			f.emit(line)
+			continue
+		}
+		if f.proseOnly && f.passThrough(lineNum, line, nextLine) {
+			if f.newLineRunes != 0 {
+				f.flushLine()
+			}
+			f.emit(line)
+			continue
+		}
+		if (lineNum == 1 && trimmedLine == "---") || f.frontMatter {
+			// Emit the front matter verbatim.
+			f.frontMatter = lineNum == 1 || (trimmedLine != "---" && trimmedLine != "...")
+			f.emit(line)
+			continue
+		}
+		// The content of comments and HTML tables is opaque: a fence or
+		// blank line within it neither opens a code block nor ends a
+		// paragraph.
+		if f.inComment {
+			f.inComment = !strings.Contains(line, "-->")
+			f.emit(line)
+			continue
+		}
+		if f.inHTMLTable {
+			f.htmlTableLine(line)
+			continue
+		}
+		// Quote markers come first: a fence within a quote opens a code
+		// block, which the end of the quote closes, and only a fence at
+		// the same quote depth closes it. Within it, a line starting with
+		// more quote markers is just code.
+		depth, quoteLen := countQuoteDepth(line)
+		if f.inCode && depth < f.codeQuoteDepth {
+			f.inCode = false
+		}
+		fenceLine := strings.TrimSpace(line[quoteLen:])
+		if f.inCode && depth != f.codeQuoteDepth {
+			fenceLine = ""
+		}
+		if f.isFence(fenceLine) {
 			// Check if we're entering or exiting a code block.
 			if !f.inCode {
+				f.codeQuoteDepth = depth
+				f.quoteDepth = depth
 				if f.newLineRunes != 0 {
 					f.flushLine()
 				}
-				f.setListState(listState{})
+				item := f.list
+				if item.typ == noList {
+					item = f.listBeforeBlank
+				}
+				if item.typ != noList && countListIndent(line).indent >= item.contentIndent() {
+					// A code block within a list item, which
+					// continues after it.
+					if f.list.typ == noList {
+						f.setListState(item)
+						f.appliedFirstList = true
+					}
+					f.flushEmptyItem()
+				} else {
+					f.setListState(listState{})
+				}
+				f.listBeforeBlank = listState{}
+				f.openedLine = lineNum
 			}
 			f.inCode = !f.inCode
-			f.writeToLine(trimmedLine)
+			// Keep the fence's indentation, which places the code
+			// block within a list item.
+			f.writeToLine(strings.TrimRightFunc(line, unicode.IsSpace))
+			f.flushLine()
+			continue
+		}
+		if len(trimmedLine) == 0 && f.inCode {
 			f.flushLine()
 			continue
 		}
@@ -172,7 +1458,10 @@ func (f *fmtState) process(in io.Reader) {
 			if f.newLineRunes != 0 {
 				f.flushLine()
 			}
+			f.listBeforeBlank = f.list
 			f.setListState(listState{})
+			f.quoteDepth = 0
+			f.spans = spanTracker{}
 			f.flushLine()
 			continue
 		}
@@ -182,40 +1471,235 @@ func (f *fmtState) process(in io.Reader) {
 			f.flushLine()
 			continue
 		}
+		if htmlTableStartExp.MatchString(trimmedLine) {
+			if f.newLineRunes != 0 {
+				f.flushLine()
+			}
+			f.setListState(listState{})
+			f.openedLine = lineNum
+			f.htmlTableLine(line)
+			continue
+		}
+		if isHTMLTagLine(trimmedLine) {
+			// Emit block-level HTML tags like <details> verbatim, but
+			// keep wrapping the markdown between them.
+			if f.newLineRunes != 0 {
+				f.flushLine()
+			}
+			f.setListState(listState{})
+			f.writeToLine(line)
+			f.flushLine()
+			continue
+		}
+		if args, ok := parseDirective(trimmedLine); ok {
+			if f.newLineRunes != 0 {
+				f.flushLine()
+			}
+			f.setListState(listState{})
+			if err := f.applyDirective(args); err != nil {
+				return fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			f.writeToLine(line)
+			f.flushLine()
+			continue
+		}
+		if isCommentLine(trimmedLine) {
+			// Emit HTML comments on lines of their own verbatim.
+			if f.newLineRunes != 0 {
+				f.flushLine()
+			}
+			f.setListState(listState{})
+			f.inComment = commentOpen(line)
+			f.openedLine = lineNum
+			f.writeToLine(line)
+			f.flushLine()
+			continue
+		}
 
 		quoteDepth, quoteLen := countQuoteDepth(line)
 		quotePrefix := strings.Repeat("> ", quoteDepth)
 		line = line[quoteLen:]
+		startsQuote := quoteDepth > f.quoteDepth
+		if quoteDepth != f.quoteDepth {
+			f.inParagraph = false
+		}
+		if startsQuote && f.newLineRunes != 0 {
+			// A new quote interrupts the paragraph. A line that is
+			// quoted less deeply, however, lazily continues it.
+			f.flushLine()
+		}
+		if quoteDepth != f.quoteDepth && (f.newLineRunes == 0 || countListIndent(line).typ != noList) {
+			// Lists don't continue into or out of a quote, and a
+			// list item can't lazily continue a paragraph.
+			if f.newLineRunes != 0 {
+				f.flushLine()
+			}
+			f.setListState(listState{})
+			f.listBeforeBlank = listState{}
+			f.closeLists(0)
+		}
+		f.quoteDepth = quoteDepth
+
+		if quoteDepth > 0 && len(strings.TrimSpace(line)) == 0 {
+			// A blank line within a quote, separating paragraphs.
+			if f.newLineRunes != 0 {
+				f.flushLine()
+			}
+			f.listBeforeBlank = f.list
+			f.setListState(listState{})
+			f.writeToLine(quotePrefix)
+			f.flushLine()
+			continue
+		}
+		if startsQuote && alertExp.MatchString(strings.TrimSpace(line)) {
+			// Keep the alert or callout marker, and any title, on
+			// its own line.
+			if f.newLineRunes != 0 {
+				f.flushLine()
+			}
+			f.setListState(listState{})
+			f.writeToLine(quotePrefix)
+			f.writeToLine(strings.TrimSpace(line))
+			f.flushLine()
+			continue
+		}
+
+		inIndentedCode := f.inIndentedCode
+		f.inIndentedCode = false
+		if item := f.list; item.typ == noList && f.listBeforeBlank.typ == noList {
+			if !f.inParagraph && f.newLineRunes == 0 && isIndentedCode(line, 0) {
+				// Leave indented code blocks alone.
+				f.writeToLine(quotePrefix)
+				f.writeToLine(strings.TrimRightFunc(line, unicode.IsSpace))
+				f.flushCodeLine()
+				continue
+			}
+		} else if item.typ == noList || inIndentedCode {
+			// An indented code block within a list item must follow
+			// a blank line or another line of code.
+			if item.typ == noList {
+				item = f.listBeforeBlank
+			}
+			if isIndentedCode(line, item.contentIndent()) {
+				if f.newLineRunes != 0 {
+					f.flushLine()
+				}
+				if f.list.typ == noList {
+					f.setListState(item)
+					f.appliedFirstList = true
+				}
+				f.listBeforeBlank = listState{}
+				f.inIndentedCode = true
+				f.writeToLine(quotePrefix)
+				f.writeToLine(strings.TrimRightFunc(line, unicode.IsSpace))
+				f.flushCodeLine()
+				continue
+			}
+		}
+
+		if isTableRow(line, len(f.table) != 0) || len(f.table) == 0 && isTableHeader(line, nextLine) {
+			// Collect the table's rows to emit them all at once.
+			if f.newLineRunes != 0 {
+				f.flushLine()
+			}
+			f.table = append(f.table, quotePrefix+line)
+			continue
+		}
+
+		if isThematicBreak(line) {
+			// Also covers setext heading underlines made of '-'.
+			if f.newLineRunes != 0 {
+				f.flushLine()
+			}
+			f.setListState(listState{})
+			f.writeToLine(quotePrefix)
+			f.writeToLine(strings.TrimSpace(line))
+			f.flushLine()
+			continue
+		}
 
 		newList := countListIndent(line)
+		if def, ok := definitionItem(line); ok && f.defLists && newList.typ == noList {
+			newList = def
+		}
+		if prev := f.listBeforeBlank; prev.typ != noList && newList.typ == noList && newList.indent == prev.contentIndent() {
+			// A continuation paragraph of the list item before the blank line.
+			f.setListState(prev)
+			f.appliedFirstList = true
+		}
+		f.listBeforeBlank = listState{}
 		if newList.typ != noList {
 			if f.newLineRunes != 0 {
 				f.flushLine()
 			}
+			newList.symbol = f.itemSymbol(newList)
 			f.setListState(newList)
-		} else if f.list.typ != noList && newList.indent != f.list.indent+f.list.typ.runes()+1 {
+		} else if f.list.typ != noList && newList.indent != f.list.contentIndent() {
 			if f.newLineRunes != 0 {
 				f.flushLine()
 			}
 			f.setListState(listState{})
 		}
+		if newList.typ == noList {
+			f.closeLists(newList.indent)
+		}
+		if newList.typ == noList && (headingExp.MatchString(strings.TrimLeft(line, " ")) || isSetextUnderline(line) || linkDefExp.MatchString(line)) {
+			// Keep headings, setext heading underlines, and link
+			// reference definitions on lines of their own.
+			if f.newLineRunes != 0 {
+				f.flushLine()
+			}
+			f.writeToLine(quotePrefix)
+			f.writeToLine(strings.TrimRightFunc(line, unicode.IsSpace))
+			f.flushLine()
+			f.inParagraph = false
+			continue
+		}
 		var listPrefix string
 		if f.list.typ != noList {
-			if newList.typ != noList {
+			if !f.appliedFirstList {
+				// Also covers content following a line with just
+				// a list marker.
 				listPrefix = f.listPrefixFirst
 			} else {
 				listPrefix = f.listPrefixRest
 			}
+		} else if f.inParagraph {
+			listPrefix = f.paraIndent + f.hangingPrefix
+		} else {
+			// Keep the indentation of the paragraph's first line.
+			f.paraIndent = line[:newList.indentBytes]
+			listPrefix = f.paraIndent
+		}
+		if newList.typ != noList {
+			line = line[newList.indentBytes+len(newList.marker):]
+		}
+		// A comment that continues onto the following lines isn't
+		// wrapped, so set it aside to go through unchanged.
+		var openComment string
+		if i := strings.LastIndex(line, "<!--"); i >= 0 && commentOpen(line) && strings.Count(line[:i], "`")%2 == 0 {
+			line, openComment = line[:i], strings.TrimRightFunc(line[i:], unicode.IsSpace)
 		}
-		line = line[f.list.indentBytes+len(f.list.typ.symbol()):]
 
-		sw := bufio.NewScanner(strings.NewReader(line))
-		sw.Split(bufio.ScanWords)
-		for sw.Scan() {
-			word := sw.Text()
-			if f.newLineRunes != 0 && f.newLineRunes+len([]rune(word)) > f.charsPerLine {
+		// A line ending in two spaces or a backslash is a hard line
+		// break, so the line after it starts a new line too.
+		hardBreak := openComment == "" && (strings.HasSuffix(line, "  ") || hasBackslashBreak(line))
+		words := splitWords(line)
+		wordOff := len(rawLine) - len(line) // where to look for the next word in the input line
+		for i, word := range words {
+			// A comment at the end of a line stays attached to the
+			// word before it, unless it goes on a line of its own.
+			trailingComment := i == len(words)-1 && isComment(word)
+			commentNext := !f.commentOwnLine && (i == len(words)-2 && isComment(words[i+1]) || i == len(words)-1 && openComment != "")
+			if trailingComment && f.commentOwnLine && f.newLineRunes != 0 {
 				f.flushLine()
 			}
+			if f.newLineRunes != 0 && !trailingComment && f.newLineRunes+utf8.RuneCountInString(word) > f.charsPerLine {
+				f.wrapLine()
+			}
+			if i == len(words)-1 {
+				f.hardBreak = hardBreak
+			}
 			if f.newLineRunes == 0 {
 				f.writeToLine(quotePrefix)
 				f.writeToLine(listPrefix)
@@ -223,21 +1707,324 @@ func (f *fmtState) process(in io.Reader) {
 					f.appliedFirstList = true
 					listPrefix = f.listPrefixRest
 				}
+				if f.list.typ == noList {
+					f.inParagraph = true
+					listPrefix = f.paraIndent + f.hangingPrefix
+				}
+				f.prefixBytes = f.newLine.Len()
+				f.lineWords = 0
+				f.lineUnits = nil
+			}
+			if trailingComment && !f.commentOwnLine && len(f.lineUnits) != 0 {
+				f.lineUnits[len(f.lineUnits)-1] += " " + word
+			} else {
+				f.lineUnits = append(f.lineUnits, word)
 			}
+			f.lastWordStart = f.newLine.Len()
+			f.lineWords++
 			f.writeToLine(word)
-			if endsSentence(word) {
+			if f.diagOut != nil {
+				// Find the word in the input line, for its column.
+				first := strings.FieldsFunc(word, isBreakingSpace)[0]
+				start := wordOff + strings.Index(rawLine[wordOff:], first)
+				wordOff = start + len(first)
+				if f.lineWords == 1 && f.newLineRunes > f.charsPerLine {
+					f.diagnose(lineNum, utf8.RuneCountInString(rawLine[:start])+1, "warning", "too-long",
+						"%q is too long to fit within the width of %d", word, f.charsPerLine)
+				}
+			}
+			f.spans.update(word)
+			if trailingComment && f.commentOwnLine {
 				f.flushLine()
-			} else {
+			} else if commentNext {
 				f.writeToLine(" ")
+			} else if (f.sentenceBreaks && endsSentence(word)) || (f.clausePunct != "" && !f.spans.inside() && endsClause(word, f.clausePunct)) {
+				f.flushLine()
+			} else {
+				f.writeToLine(f.space(word))
+			}
+		}
+		if openComment != "" {
+			// The comment ends the line, attached to the word before it
+			// like any other comment at the end of a line, and the lines
+			// it continues onto are emitted verbatim.
+			if f.commentOwnLine && f.newLineRunes != 0 {
+				f.flushLine()
+			}
+			if f.newLineRunes == 0 {
+				f.writeToLine(quotePrefix)
+				f.writeToLine(listPrefix)
+				f.appliedFirstList = true
+				if f.list.typ == noList {
+					f.inParagraph = true
+				}
+				f.prefixBytes = f.newLine.Len()
+				f.lineUnits = nil
+			}
+			if !f.commentOwnLine && len(f.lineUnits) != 0 {
+				f.lineUnits[len(f.lineUnits)-1] += " " + openComment
+			} else {
+				f.lineUnits = append(f.lineUnits, openComment)
 			}
+			f.writeToLine(openComment)
+			f.flushLine()
+			f.inComment = true
+			f.openedLine = lineNum
+		}
+		if f.hardBreak && f.newLineRunes != 0 {
+			f.flushLine()
 		}
 	}
 	if f.newLineRunes != 0 {
 		f.flushLine()
 	}
+	if len(f.table) != 0 {
+		f.flushTable()
+	}
+	f.setListState(listState{})
+	if err := s.Err(); err != nil {
+		return err
+	}
+	switch {
+	case f.inCode:
+		f.diagnose(f.openedLine, 1, "warning", "unclosed", "code block is never closed")
+	case f.inComment:
+		f.diagnose(f.openedLine, 1, "warning", "unclosed", "HTML comment is never closed")
+	case f.inHTMLTable:
+		f.diagnose(f.openedLine, 1, "warning", "unclosed", "HTML table is never closed")
+	}
+	switch f.finalNewline {
+	case keepFinalNewline:
+		if lr.last != '\n' {
+			return nw.finish(nw.pending - 1)
+		}
+		return nw.finish(-1)
+	case oneFinalNewline:
+		return nw.finish(1)
+	}
+	return nw.finish(0)
 }
 
 func main() {
 	fs := newFmtState(80, os.Stdout)
-	fs.process(os.Stdin)
+	flag.IntVar(&fs.charsPerLine, "width", fs.charsPerLine, "maximum number of characters per line")
+	flag.Var(&fs.finalNewline, "final-newline", "newlines terminating the output: keep, one, or none")
+	flag.Var(&fs.numbering, "numbers", "numbering of ordered list items: lazy, preserve, or renumber")
+	flag.IntVar(&fs.sentenceSpacing, "sentence-spacing", fs.sentenceSpacing, "with -no-sentence-split, the number of spaces to follow the end of a sentence with")
+	noSentenceSplit := flag.Bool("no-sentence-split", false, "don't start a new line after the end of each sentence, only wrapping at the width")
+	flag.StringVar(&fs.clausePunct, "clause-breaks", "", "also start a new line after any of these clause-ending punctuation characters, e.g. \",;:\"")
+	flag.BoolVar(&fs.expandTabs, "expand-tabs", false, "replace tabs in the output with spaces, except in code blocks")
+	flag.BoolVar(&fs.expandCodeTabs, "expand-code-tabs", false, "with -expand-tabs, also replace tabs in code blocks")
+	flag.IntVar(&fs.tabWidth, "tab-width", fs.tabWidth, "columns between tab stops for -expand-tabs")
+	flag.BoolVar(&fs.avoidWidows, "avoid-widows", false, "avoid ending a paragraph with a line containing a single word")
+	flag.BoolVar(&fs.balance, "balance", false, "break lines to minimize raggedness, rather than greedily filling each line")
+	flag.BoolVar(&fs.commentOwnLine, "comment-line", false, "put an HTML comment ending a line on a line of its own, rather than after the word before it")
+	flag.BoolVar(&fs.wrapTables, "wrap-tables", false, "normalize the whitespace in pipe table cells and pad them to align each column")
+	flag.BoolVar(&fs.wrapHTMLCells, "wrap-html-cells", false, "wrap the text of <td> and <th> cells on lines of their own in raw HTML tables")
+	flag.BoolVar(&fs.defLists, "def-lists", false, "recognize definition lists, keeping each definition's \":\" marker and its alignment")
+	flag.BoolVar(&fs.proseOnly, "prose-only", false, "only wrap top-level paragraphs, leaving all other lines untouched")
+	flag.IntVar(&fs.maxBlank, "max-blank", 0, "emit at most this many consecutive blank lines outside of code blocks (default: as in the input)")
+	jsonDiag := flag.Bool("json-diag", false, "report problems with the input, like words too long to fit or wrapping that changes if repeated, as JSON lines on stderr")
+	stdinName := flag.String("stdin-name", "<stdin>", "name of the input when reading STDIN, for errors and diagnostics")
+	hanging := flag.Int("hanging", 0, "indent all but the first line of each paragraph outside of a list by this many spaces")
+	list := flag.Bool("l", false, "list files whose wrapping differs from md-wrap's, and exit non-zero if there are any")
+	diff := flag.Bool("d", false, "display diffs of files whose wrapping differs from md-wrap's, and exit non-zero if there are any")
+	flag.Parse()
+	configDir := "."
+	if flag.NArg() != 0 {
+		configDir = filepath.Dir(flag.Arg(0))
+	}
+	if err := loadConfig(flag.CommandLine, configDir); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if fs.charsPerLine <= 0 {
+		fmt.Fprintf(os.Stderr, "error: -width must be positive\n")
+		os.Exit(1)
+	}
+	if fs.tabWidth <= 0 {
+		fmt.Fprintf(os.Stderr, "error: -tab-width must be positive\n")
+		os.Exit(1)
+	}
+	if fs.maxBlank < 0 {
+		fmt.Fprintf(os.Stderr, "error: -max-blank must not be negative\n")
+		os.Exit(1)
+	}
+	if fs.sentenceSpacing < 1 {
+		fmt.Fprintf(os.Stderr, "error: -sentence-spacing must be positive\n")
+		os.Exit(1)
+	}
+	if *hanging < 0 {
+		fmt.Fprintf(os.Stderr, "error: -hanging must not be negative\n")
+		os.Exit(1)
+	}
+	fs.hangingPrefix = strings.Repeat(" ", *hanging)
+	fs.sentenceBreaks = !*noSentenceSplit
+	if *jsonDiag {
+		fs.diagOut = os.Stderr
+	}
+
+	if flag.NArg() == 0 {
+		if *list || *diff {
+			fmt.Fprintf(os.Stderr, "error: -l and -d require file arguments\n")
+			os.Exit(1)
+		}
+		// Output is written a line at a time, so buffer it.
+		out := bufio.NewWriter(os.Stdout)
+		fs.out = out
+		fs.diagFile = *stdinName
+		err := fs.process(os.Stdin)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", *stdinName, err)
+		}
+		if ferr := out.Flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	exitCode := 0
+	for _, path := range flag.Args() {
+		changed, err := processFile(fs, path, *list, *diff)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			exitCode = 1
+		}
+		if changed {
+			exitCode = 1
+		}
+	}
+	os.Exit(exitCode)
+}
+
+// configName is the name of md-wrap's configuration file.
+const configName = ".mdwrap.json"
+
+// loadConfig looks for a configuration file in dir and each of its
+// parents, and applies the first one found to the flags in fset. The
+// file holds a JSON object mapping flag names to values, such as
+//
+//	{"width": 72, "avoid-widows": true}
+//
+// which serve as defaults for any flags not set on the command line.
+func loadConfig(fset *flag.FlagSet, dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	var path string
+	for {
+		path = filepath.Join(dir, configName)
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	set := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, value := range config {
+		if fset.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown flag %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fset.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// processFile wraps the file at path according to the configuration
+// in cfg. If neither list nor diff is set, the result is written to
+// cfg's output. Otherwise, it reports whether the file's wrapping
+// differs from the result, listing its path and/or printing a diff
+// as requested.
+func processFile(cfg *fmtState, path string, list, diff bool) (bool, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var buf bytes.Buffer
+	f := *cfg
+	f.out = &buf
+	f.diagFile = path
+	if err := f.process(bytes.NewReader(src)); err != nil {
+		return false, fmt.Errorf("%s: %v", path, err)
+	}
+	res := buf.Bytes()
+	if !list && !diff {
+		_, err := cfg.out.Write(res)
+		return false, err
+	}
+	if bytes.Equal(src, res) {
+		return false, nil
+	}
+	if list {
+		fmt.Fprintln(cfg.out, path)
+	}
+	if diff {
+		d, err := diffFile(path, src, res)
+		if err != nil {
+			return true, err
+		}
+		cfg.out.Write(d)
+	}
+	return true, nil
+}
+
+// diffFile returns a unified diff between the old and new contents
+// of the file at path, using the system's diff utility.
+func diffFile(path string, old, new []byte) ([]byte, error) {
+	oldFile, err := writeTempFile(old)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(oldFile)
+	newFile, err := writeTempFile(new)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(newFile)
+
+	d, err := exec.Command("diff", "-u", "--label", path+".orig", "--label", path, oldFile, newFile).Output()
+	if len(d) > 0 {
+		// diff exits with a non-zero status if the files differ.
+		err = nil
+	}
+	return d, err
+}
+
+func writeTempFile(data []byte) (string, error) {
+	f, err := ioutil.TempFile("", "md-wrap")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
 }
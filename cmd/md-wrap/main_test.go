@@ -0,0 +1,783 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// wrap formats in at the given width, with the fmtState first
+// configured by setup if it's non-nil.
+func wrap(t testing.TB, width int, setup func(*fmtState), in string) string {
+	t.Helper()
+	var out bytes.Buffer
+	f := newFmtState(width, &out)
+	if setup != nil {
+		setup(f)
+	}
+	if err := f.process(strings.NewReader(in)); err != nil {
+		t.Fatalf("process: %v", err)
+	}
+	return out.String()
+}
+
+var wrapTests = []struct {
+	name  string
+	width int
+	setup func(*fmtState)
+	in    string
+	want  string
+}{
+	{
+		name:  "paragraph",
+		width: 40,
+		in:    "A paragraph that is long enough that it has to be wrapped. And a second sentence.\n",
+		want: "A paragraph that is long enough that it\n" +
+			"has to be wrapped.\n" +
+			"And a second sentence.\n",
+	},
+	{
+		name:  "list item paragraphs",
+		width: 30,
+		in: "* The first paragraph of an item that wraps\n" +
+			"\n" +
+			"  The second paragraph of the same item\n",
+		want: "* The first paragraph of an\n" +
+			"  item that wraps\n" +
+			"\n" +
+			"  The second paragraph of the\n" +
+			"  same item\n",
+	},
+	{
+		name:  "footnote",
+		width: 30,
+		in:    "[^1]: A footnote that is long enough to wrap around.\n",
+		want: "[^1]: A footnote that is long\n" +
+			"enough to wrap around.\n",
+	},
+	{
+		name:  "width directive",
+		width: 40,
+		in: "A paragraph that is wrapped at the default width of forty.\n" +
+			"\n" +
+			"<!-- md-wrap: width=20 -->\n" +
+			"A paragraph that is wrapped at twenty.\n",
+		want: "A paragraph that is wrapped at the\n" +
+			"default width of forty.\n" +
+			"\n" +
+			"<!-- md-wrap: width=20 -->\n" +
+			"A paragraph that is\n" +
+			"wrapped at twenty.\n",
+	},
+	{
+		name:  "alert",
+		width: 40,
+		in:    "> [!NOTE]\n> Alert text that continues.\n",
+		want:  "> [!NOTE]\n> Alert text that continues.\n",
+	},
+	{
+		name:  "obsidian callout",
+		width: 40,
+		in:    "> [!tip]- A collapsed title\n> Callout text.\n",
+		want:  "> [!tip]- A collapsed title\n> Callout text.\n",
+	},
+	{
+		name:  "inline html span",
+		width: 20,
+		in:    "Press <kbd>Ctrl Alt Delete</kbd> to restart.\n",
+		want:  "Press\n<kbd>Ctrl Alt Delete</kbd>\nto restart.\n",
+	},
+	{
+		name:  "prose only",
+		width: 20,
+		setup: func(f *fmtState) { f.proseOnly = true },
+		in: "A paragraph that is long enough to wrap.\n" +
+			"\n" +
+			"- A list item that is long enough to wrap.\n",
+		want: "A paragraph that is\n" +
+			"long enough to wrap.\n" +
+			"\n" +
+			"- A list item that is long enough to wrap.\n",
+	},
+	{
+		name:  "escaped markers",
+		width: 80,
+		in:    "\\* not a list\n\n1\\. not a list either\n\n\\> not a quote\n",
+		want:  "\\* not a list\n\n1\\. not a list either\n\n\\> not a quote\n",
+	},
+	{
+		name:  "clause breaks",
+		width: 80,
+		setup: func(f *fmtState) { f.clausePunct = ",;" },
+		in:    "First, a clause; then another, e.g., this one.\n",
+		want:  "First,\na clause;\nthen another,\ne.g., this one.\n",
+	},
+	{
+		name:  "list marker lengths",
+		width: 80,
+		setup: func(f *fmtState) { f.numbering = preserveNumbering },
+		in:    "- dash\n\n+ plus\n\n10. ten\n",
+		want:  "- dash\n\n+ plus\n\n10. ten\n",
+	},
+	{
+		name:  "expand tabs",
+		width: 80,
+		setup: func(f *fmtState) { f.expandTabs = true },
+		in:    "```\n\tcode\n```\n\n*\ta\ttabbed item\n",
+		want:  "```\n\tcode\n```\n\n* a tabbed item\n",
+	},
+	{
+		name:  "expand code tabs",
+		width: 80,
+		setup: func(f *fmtState) { f.expandTabs, f.expandCodeTabs = true, true },
+		in:    "```\n\tcode\n```\n",
+		want:  "```\n    code\n```\n",
+	},
+	{
+		name:  "expand tabs in indented code",
+		width: 80,
+		setup: func(f *fmtState) { f.expandTabs = true },
+		in:    "Text\there.\n\n\tcode\tx\n\n* item\n\n      code\ty\n",
+		want:  "Text here.\n\n\tcode\tx\n\n* item\n\n      code\ty\n",
+	},
+	{
+		name:  "expand code tabs in indented code",
+		width: 80,
+		setup: func(f *fmtState) { f.expandTabs, f.expandCodeTabs = true, true },
+		in:    "\tcode\tx\n",
+		want:  "    code    x\n",
+	},
+	{
+		name:  "empty items",
+		width: 80,
+		in:    "1.\n\n2.\n\n- \n*\n* \t\n",
+		want:  "1.\n\n2.\n\n-\n*\n*\n",
+	},
+	{
+		name:  "empty items renumbered",
+		width: 80,
+		setup: func(f *fmtState) { f.numbering = renumberNumbering },
+		in:    "1.\n1. a\n1.\n",
+		want:  "1.\n2. a\n3.\n",
+	},
+	{
+		name:  "bullets then numbers",
+		width: 20,
+		in:    "- bullet one\n1. number one that is long enough to wrap\n2. two\n",
+		want:  "- bullet one\n1. number one that\n   is long enough to\n   wrap\n1. two\n",
+	},
+	{
+		name:  "numbers then bullets",
+		width: 20,
+		in:    "10. number that is long enough\n* bullet that is long enough to wrap\n",
+		want:  "10. number that is\n    long enough\n* bullet that is\n  long enough to\n  wrap\n",
+	},
+	{
+		name:  "quote at the width",
+		width: 20,
+		in:    "> aaaaa bbbbb cccccc d\n",
+		want:  "> aaaaa bbbbb cccccc\n> d\n",
+	},
+	{
+		name:  "nested quote at the width",
+		width: 20,
+		in:    "> > aaaaa bbbbb cccc d\n",
+		want:  "> > aaaaa bbbbb cccc\n> > d\n",
+	},
+	{
+		name:  "list in quote at the width",
+		width: 20,
+		in:    "> * aaaaa bbbbb ccc d\n",
+		want:  "> * aaaaa bbbbb ccc\n>   d\n",
+	},
+	{
+		name:  "prose after fence in list item",
+		width: 20,
+		in:    "- item prose that wraps at twenty\n\n  ```\n  code line that is long and should stay\n  ```\n\n  more prose after the code that wraps\n- next\n",
+		want:  "- item prose that\n  wraps at twenty\n\n  ```\n  code line that is long and should stay\n  ```\n\n  more prose after\n  the code that\n  wraps\n- next\n",
+	},
+	{
+		name:  "prose after fence in nested list item",
+		width: 20,
+		in:    "1. outer\n   * inner prose that wraps\n     ~~~\n     code\n     ~~~\n     inner prose after the code\n",
+		want:  "1. outer\n   * inner prose\n     that wraps\n     ~~~\n     code\n     ~~~\n     inner prose\n     after the code\n",
+	},
+	{
+		name:  "indented code in list item",
+		width: 20,
+		in:    "- item prose that wraps at twenty\n\n      code   that is   long and should stay\n      - not a list\n      1. nor this\n\n  more prose\n",
+		want:  "- item prose that\n  wraps at twenty\n\n      code   that is   long and should stay\n      - not a list\n      1. nor this\n\n  more prose\n",
+	},
+	{
+		name:  "indented code in nested list item",
+		width: 20,
+		in:    "1. outer\n   - inner\n\n         - code, not a list item\n",
+		want:  "1. outer\n   - inner\n\n         - code, not a list item\n",
+	},
+	{
+		name:  "table without outer pipes",
+		width: 10,
+		in:    "Text before the table.\na | b c d e f\n--|:-:\n1 | 2 \\| x y z\n\nText after the table.\n",
+		want:  "Text\nbefore the\ntable.\na | b c d e f\n--|:-:\n1 | 2 \\| x y z\n\nText after\nthe table.\n",
+	},
+	{
+		name:  "align table without outer pipes",
+		width: 80,
+		setup: func(f *fmtState) { f.wrapTables = true },
+		in:    "> a | b\n> - | -:\n> 1 | 22\n",
+		want:  "> | a   | b   |\n> | --- | --: |\n> | 1   | 22  |\n",
+	},
+	{
+		name:  "prose only table without outer pipes",
+		width: 10,
+		setup: func(f *fmtState) { f.proseOnly = true },
+		in:    "a | b c d e f\n--|--\n1 | 2 3 4 5 6\n",
+		want:  "a | b c d e f\n--|--\n1 | 2 3 4 5 6\n",
+	},
+	{
+		name:  "not a table",
+		width: 80,
+		in:    "a \\| b\n---\n\na | b\n---\n",
+		want:  "a \\| b\n---\n\na | b\n---\n",
+	},
+	{
+		name:  "backslash hard break",
+		width: 80,
+		in:    "First line\\\nsecond line \\\\\nthird line\n",
+		want:  "First line\\\nsecond line \\\\ third line\n",
+	},
+	{
+		name:  "backslash hard break in list item",
+		width: 10,
+		in:    "* one two three\\\n  four\n",
+		want:  "* one two\n  three\\\n  four\n",
+	},
+	{
+		name:  "escaped backslash with spaces",
+		width: 80,
+		in:    "a\\\\  \nb\n",
+		want:  "a\\\\  \nb\n",
+	},
+	{
+		name:  "directive followed by comment",
+		width: 80,
+		in:    "<!-- md-wrap: width=10 --> <!-- narrow -->\naaa bbb ccc\n",
+		want:  "<!-- md-wrap: width=10 --> <!-- narrow -->\naaa bbb\nccc\n",
+	},
+	{
+		name:  "details",
+		width: 30,
+		in: "<details>\n<summary>Summary</summary>\n\n" +
+			"Text inside the details that wraps.\n\n</details>\n",
+		want: "<details>\n<summary>Summary</summary>\n\n" +
+			"Text inside the details that\nwraps.\n\n</details>\n",
+	},
+	{
+		name:  "stop and start",
+		width: 20,
+		in: "<!-- md-wrap: stop -->\n" +
+			"A line that is left alone although it's long.\n" +
+			"<!-- md-wrap: start -->\n" +
+			"A line that is wrapped at twenty.\n",
+		want: "<!-- md-wrap: stop -->\n" +
+			"A line that is left alone although it's long.\n" +
+			"<!-- md-wrap: start -->\n" +
+			"A line that is\nwrapped at twenty.\n",
+	},
+	{
+		name:  "image",
+		width: 20,
+		in:    "See ![an image with long alt text](img.png) here.\n",
+		want:  "See\n![an image with long alt text](img.png)\nhere.\n",
+	},
+	{
+		name:  "avoid widows",
+		width: 30,
+		setup: func(f *fmtState) { f.avoidWidows = true },
+		in:    "One two three four five six seven eight\n",
+		want:  "One two three four five six\nseven eight\n",
+	},
+	{
+		name:  "hanging indent",
+		width: 30,
+		setup: func(f *fmtState) { f.hangingPrefix = "  " },
+		in:    "A paragraph with a hanging indent that wraps\n",
+		want:  "A paragraph with a hanging\n  indent that wraps\n",
+	},
+	{
+		name:  "quote paragraphs",
+		width: 80,
+		in:    "> First paragraph.\n>\n> Second paragraph.\n",
+		want:  "> First paragraph.\n>\n> Second paragraph.\n",
+	},
+	{
+		name:  "indented prose",
+		width: 30,
+		in:    "  An indented paragraph that is long enough to wrap\n",
+		want:  "  An indented paragraph that\n  is long enough to wrap\n",
+	},
+	{
+		name:  "preserve numbers from 5",
+		width: 80,
+		setup: func(f *fmtState) { f.numbering = preserveNumbering },
+		in:    "5. five\n7. seven\n",
+		want:  "5. five\n7. seven\n",
+	},
+	{
+		name:  "renumber from 5",
+		width: 80,
+		setup: func(f *fmtState) { f.numbering = renumberNumbering },
+		in:    "5. five\n7. seven\n",
+		want:  "5. five\n6. seven\n",
+	},
+	{
+		name:  "lazy numbers from 5",
+		width: 80,
+		in:    "5. five\n7. seven\n",
+		want:  "5. five\n5. seven\n",
+	},
+	{
+		name:  "trailing comment",
+		width: 30,
+		in:    "Some words then a comment <!-- keep me together -->\n",
+		want:  "Some words then a comment <!-- keep me together -->\n",
+	},
+	{
+		name:  "trailing comment on own line",
+		width: 30,
+		setup: func(f *fmtState) { f.commentOwnLine = true },
+		in:    "Some words <!-- a comment -->\n",
+		want:  "Some words\n<!-- a comment -->\n",
+	},
+	{
+		name:  "multi-line trailing comment",
+		width: 20,
+		in:    "Some words that wrap around. <!-- a  note\nthat   spans lines -->\nMore words.\n",
+		want:  "Some words that wrap\naround. <!-- a  note\nthat   spans lines -->\nMore words.\n",
+	},
+	{
+		name:  "multi-line trailing comment on own line",
+		width: 20,
+		setup: func(f *fmtState) { f.commentOwnLine = true },
+		in:    "Some words <!-- a  note\nthat spans -->\n",
+		want:  "Some words\n<!-- a  note\nthat spans -->\n",
+	},
+	{
+		name:  "balance",
+		width: 6,
+		setup: func(f *fmtState) { f.balance = true },
+		in:    "aaa bb cc ddddd\n",
+		want:  "aaa\nbb cc\nddddd\n",
+	},
+	{
+		name:  "comments",
+		width: 20,
+		in: "<!-- a comment line that is long -->\n" +
+			"<!--\na multi-line comment that is long\n-->\n",
+		want: "<!-- a comment line that is long -->\n" +
+			"<!--\na multi-line comment that is long\n-->\n",
+	},
+	{
+		name:  "fence in comment",
+		width: 20,
+		in:    "<!--\n```\nhidden\n-->\n\nA paragraph that is long enough to wrap.\n",
+		want:  "<!--\n```\nhidden\n-->\n\nA paragraph that is\nlong enough to wrap.\n",
+	},
+	{
+		name:  "non-breaking space",
+		width: 10,
+		in:    "aaaa bbbb\u00a0cccc\n",
+		want:  "aaaa\nbbbb\u00a0cccc\n",
+	},
+	{
+		name:  "sentences in list item",
+		width: 80,
+		in:    "* One sentence. Two sentences.\n",
+		want:  "* One sentence.\n  Two sentences.\n",
+	},
+	{
+		name:  "fence in list item",
+		width: 80,
+		in:    "* item\n\n    ```\n    code\n    ```\n",
+		want:  "* item\n\n    ```\n    code\n    ```\n",
+	},
+	{
+		name:  "wrap tables",
+		width: 20,
+		setup: func(f *fmtState) { f.wrapTables = true },
+		in:    "| a | b |\n|:-|-:|\n| a very wide cell | x |\n",
+		want:  "| a                | b   |\n| :--------------- | --: |\n| a very wide cell | x   |\n",
+	},
+	{
+		name:  "pipe table",
+		width: 20,
+		in:    "| a | b |\n|---|---|\n| a very wide cell that is long | x |\n",
+		want:  "| a | b |\n|---|---|\n| a very wide cell that is long | x |\n",
+	},
+	{
+		name:  "quote before list",
+		width: 80,
+		in:    "> quote\n1. one\n2. two\n",
+		want:  "> quote\n1. one\n1. two\n",
+	},
+	{
+		name:  "no sentence split",
+		width: 80,
+		setup: func(f *fmtState) { f.sentenceBreaks = false },
+		in:    "One sentence. Two sentences.\n",
+		want:  "One sentence. Two sentences.\n",
+	},
+	{
+		name:  "sentence spacing",
+		width: 80,
+		setup: func(f *fmtState) { f.sentenceBreaks, f.sentenceSpacing = false, 2 },
+		in:    "One sentence. Two sentences.\n",
+		want:  "One sentence.  Two sentences.\n",
+	},
+	{
+		name:  "hard break",
+		width: 80,
+		in:    "A line with a hard break  \nthen another line\nthat is joined.\n",
+		want:  "A line with a hard break  \nthen another line that is joined.\n",
+	},
+	{
+		name:  "front matter",
+		width: 20,
+		in:    "---\ntitle: a title that is long enough to wrap\n---\n\nText.\n",
+		want:  "---\ntitle: a title that is long enough to wrap\n---\n\nText.\n",
+	},
+	{
+		name:  "headings",
+		width: 20,
+		in:    "# A heading that is long enough to wrap\n\nSetext heading\n===\n",
+		want:  "# A heading that is long enough to wrap\n\nSetext heading\n===\n",
+	},
+	{
+		name:  "paren list",
+		width: 20,
+		in:    "10) a list item that wraps around\n",
+		want:  "10) a list item that\n    wraps around\n",
+	},
+	{
+		name:  "max blank",
+		width: 80,
+		setup: func(f *fmtState) { f.maxBlank = 1 },
+		in:    "a\n\n\n\nb\n```\n\n\n```\n",
+		want:  "a\n\nb\n```\n\n\n```\n",
+	},
+	{
+		name:  "tilde fence",
+		width: 20,
+		in:    "~~~\na code line that is too long\n~~~\n",
+		want:  "~~~\na code line that is too long\n~~~\n",
+	},
+	{
+		name:  "longer fence",
+		width: 20,
+		in:    "````\n```go\na code line that is too long\n```\n````\n",
+		want:  "````\n```go\na code line that is too long\n```\n````\n",
+	},
+	{
+		name:  "link definitions",
+		width: 20,
+		in:    "[a]: https://example.com/a\n[b]: https://example.com/b \"Title\"\n",
+		want:  "[a]: https://example.com/a\n[b]: https://example.com/b \"Title\"\n",
+	},
+	{
+		name:  "html table",
+		width: 20,
+		in:    "<table>\n<tr><td>a cell that is long enough</td></tr>\n</table>\n",
+		want:  "<table>\n<tr><td>a cell that is long enough</td></tr>\n</table>\n",
+	},
+	{
+		name:  "fence in html table",
+		width: 20,
+		in:    "<table>\n<tr><td>\n\n```\n\n</td></tr>\n</table>\n\nA paragraph that is long enough to wrap.\n",
+		want:  "<table>\n<tr><td>\n\n```\n\n</td></tr>\n</table>\n\nA paragraph that is\nlong enough to wrap.\n",
+	},
+	{
+		name:  "wrap html cells",
+		width: 20,
+		setup: func(f *fmtState) { f.wrapHTMLCells = true },
+		in:    "<table>\n<tr>\n  <td>a cell that is long enough</td>\n</tr>\n</table>\n",
+		want:  "<table>\n<tr>\n  <td>a cell that is\n  long enough</td>\n</tr>\n</table>\n",
+	},
+	{
+		name:  "quoted code closed by quote",
+		width: 20,
+		in:    "> ```\n> quoted code that is long\n\nText after.\n",
+		want:  "> ```\n> quoted code that is long\n\nText after.\n",
+	},
+	{
+		name:  "quote marker in code",
+		width: 20,
+		in:    "```\n> ```\nstill code that is long\n```\n",
+		want:  "```\n> ```\nstill code that is long\n```\n",
+	},
+	{
+		name:  "definition list",
+		width: 30,
+		setup: func(f *fmtState) { f.defLists = true },
+		in: "Apple\n  :   A fruit that grows on trees in orchards.\n" +
+			"Banana\n  :   A long yellow fruit.\n",
+		want: "Apple\n  :   A fruit that grows on\n      trees in orchards.\n" +
+			"Banana\n  :   A long yellow fruit.\n",
+	},
+}
+
+func TestWrap(t *testing.T) {
+	for _, tt := range wrapTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wrap(t, tt.width, tt.setup, tt.in); got != tt.want {
+				t.Errorf("wrapping\n%s\ngot\n%s\nwant\n%s", tt.in, got, tt.want)
+			}
+			// Wrapping is idempotent.
+			if got := wrap(t, tt.width, tt.setup, tt.want); got != tt.want {
+				t.Errorf("rewrapping\n%s\ngot\n%s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFinalNewline(t *testing.T) {
+	for _, tt := range []struct {
+		policy finalNewline
+		in     string
+		want   string
+	}{
+		{keepFinalNewline, "a\n\n\n", "a\n\n\n"},
+		{keepFinalNewline, "a", "a"},
+		{oneFinalNewline, "a\n\n\n", "a\n"},
+		{oneFinalNewline, "a", "a\n"},
+		{noFinalNewline, "a\n\n", "a"},
+	} {
+		got := wrap(t, 80, func(f *fmtState) { f.finalNewline = tt.policy }, tt.in)
+		if got != tt.want {
+			t.Errorf("-final-newline=%s: wrapping %q got %q, want %q", tt.policy, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	var diag bytes.Buffer
+	wrap(t, 10, func(f *fmtState) {
+		f.diagOut = &diag
+		f.diagFile = "<stdin>"
+	}, "a verylongword\n\n```\ncode\n")
+	want := `{"file":"<stdin>","line":1,"column":3,"severity":"warning","kind":"too-long","message":"\"verylongword\" is too long to fit within the width of 10"}
+{"file":"<stdin>","line":3,"column":1,"severity":"warning","kind":"unclosed","message":"code block is never closed"}
+`
+	if diag.String() != want {
+		t.Errorf("got diagnostics\n%s\nwant\n%s", diag.String(), want)
+	}
+}
+
+func TestUnstableDiagnostic(t *testing.T) {
+	// The "---" continuing the list item becomes a thematic break
+	// when the output is wrapped again.
+	var diag bytes.Buffer
+	got := wrap(t, 8, func(f *fmtState) { f.diagOut = &diag }, "* bbbb ---\n")
+	if want := "* bbbb\n  ---\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	want := `{"line":2,"column":1,"severity":"warning","kind":"unstable","message":"wrapping the output again changes its line 2"}
+`
+	if diag.String() != want {
+		t.Errorf("got diagnostics\n%s\nwant\n%s", diag.String(), want)
+	}
+}
+
+func TestParseDirective(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		args []string
+		ok   bool
+	}{
+		{"<!-- md-wrap: width=72 -->", []string{"width=72"}, true},
+		{"<!--md-wrap:stop-->", []string{"stop"}, true},
+		{"<!-- md-wrap: stop --> <!-- start -->", []string{"stop"}, true},
+		{"<!-- md-wrap: stop --><!-- a --> <!-- b -->", []string{"stop"}, true},
+		{"<!-- md-wrap: stop --> text", nil, false},
+		{"<!-- other --> <!-- md-wrap: stop -->", nil, false},
+	} {
+		args, ok := parseDirective(tt.line)
+		if ok != tt.ok || strings.Join(args, " ") != strings.Join(tt.args, " ") {
+			t.Errorf("parseDirective(%q) = %q, %t, want %q, %t", tt.line, args, ok, tt.args, tt.ok)
+		}
+	}
+}
+
+func TestBadDirective(t *testing.T) {
+	f := newFmtState(80, ioutil.Discard)
+	err := f.process(strings.NewReader("<!-- md-wrap: width=0 -->\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("got error %v, want one for line 1", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "md-wrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	config := `{"width": 72, "avoid-widows": true}`
+	if err := ioutil.WriteFile(filepath.Join(dir, configName), []byte(config), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	fset := flag.NewFlagSet("md-wrap", flag.ContinueOnError)
+	width := fset.Int("width", 80, "")
+	widows := fset.Bool("avoid-widows", false, "")
+	// Flags on the command line take precedence.
+	if err := fset.Parse([]string{"-avoid-widows=false"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fset, sub); err != nil {
+		t.Fatal(err)
+	}
+	if *width != 72 || *widows {
+		t.Errorf("got width %d, avoid-widows %t; want 72, false", *width, *widows)
+	}
+
+	if err := loadConfig(flag.NewFlagSet("md-wrap", flag.ContinueOnError), sub); err == nil {
+		t.Errorf("loading a config with unknown flags succeeded")
+	}
+}
+
+func TestProcessFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "md-wrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wrapped := filepath.Join(dir, "wrapped.md")
+	unwrapped := filepath.Join(dir, "unwrapped.md")
+	if err := ioutil.WriteFile(wrapped, []byte("One.\nTwo.\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(unwrapped, []byte("One. Two.\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cfg := newFmtState(80, &out)
+	for _, path := range []string{wrapped, unwrapped} {
+		if _, err := processFile(cfg, path, true, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := out.String(), unwrapped+"\n"; got != want {
+		t.Errorf("-l listed %q, want %q", got, want)
+	}
+
+	out.Reset()
+	changed, err := processFile(cfg, unwrapped, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || !strings.Contains(out.String(), "-One. Two.\n+One.\n+Two.\n") {
+		t.Errorf("-d reported changed=%t with diff\n%s", changed, out.String())
+	}
+}
+
+// TestCorpus checks that each document in testdata wraps to its golden
+// file, that wrapping is idempotent, and that wrapping preserves the
+// structure of the document.
+func TestCorpus(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no test documents in testdata")
+	}
+	for _, path := range inputs {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			in, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := strings.TrimSuffix(path, ".md") + ".golden"
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := wrap(t, 80, nil, string(in))
+			if got != string(want) {
+				t.Errorf("wrapping %s doesn't match %s; got\n%s", path, golden, got)
+			}
+			if again := wrap(t, 80, nil, got); again != got {
+				t.Errorf("wrapping %s again changed it; got\n%s", path, again)
+			}
+			checkStructure(t, string(in), got)
+		})
+	}
+}
+
+// checkStructure checks that out has the same list items and code
+// lines as in.
+func checkStructure(t *testing.T, in, out string) {
+	t.Helper()
+	inItems, inCode := structure(in)
+	outItems, outCode := structure(out)
+	if inItems != outItems {
+		t.Errorf("got %d list items, want %d", outItems, inItems)
+	}
+	if inCode != outCode {
+		t.Errorf("code lines changed; got\n%s\nwant\n%s", outCode, inCode)
+	}
+}
+
+// structure returns the number of list items in the document doc, and
+// the lines of its fenced code blocks.
+func structure(doc string) (items int, code string) {
+	var b strings.Builder
+	inCode := false
+	for _, line := range strings.Split(doc, "\n") {
+		_, quoteLen := countQuoteDepth(line)
+		line = line[quoteLen:]
+		if codeFence(strings.TrimSpace(line)) != "" {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			b.WriteString(line + "\n")
+		} else if countListIndent(line).typ != noList {
+			items++
+		}
+	}
+	return items, b.String()
+}
+
+func BenchmarkProcess(b *testing.B) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.md"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var doc strings.Builder
+	for _, path := range inputs {
+		in, err := ioutil.ReadFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		doc.Write(in)
+		doc.WriteString("\n")
+	}
+	b.SetBytes(int64(doc.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := newFmtState(80, ioutil.Discard)
+		if err := f.process(strings.NewReader(doc.String())); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package latex
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// bgRectExp matches a background rectangle at the start of the body
+// of an SVG image.
+var bgRectExp = regexp.MustCompile(`^\s*<rect\b[^>]*\bfill="[^"]*"[^>]*?(?:/>|>\s*</rect>)`)
+
+// backgroundConverter wraps a Converter, setting the background of
+// each SVG image it produces to bg.
+func backgroundConverter(c Converter, bg string) Converter {
+	return ConverterFunc(func(ctx context.Context, eq Equation, w io.Writer) error {
+		var buf bytes.Buffer
+		if err := c.Convert(ctx, eq, &buf); err != nil {
+			return err
+		}
+		svg, err := setBackground(buf.Bytes(), bg)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(svg)
+		return err
+	})
+}
+
+// setBackground returns the SVG image svg with any background
+// rectangle replaced by one filled with bg, or removed if bg is
+// "transparent".
+func setBackground(svg []byte, bg string) ([]byte, error) {
+	m := svgRootExp.FindSubmatchIndex(svg)
+	if m == nil {
+		return nil, fmt.Errorf("converter output is not an SVG image")
+	}
+	body := svg[m[4]:m[5]]
+	if loc := bgRectExp.FindIndex(body); loc != nil {
+		body = body[loc[1]:]
+	}
+	var b bytes.Buffer
+	b.Write(svg[:m[4]])
+	if bg != "transparent" {
+		// Cover the viewBox, whose origin is often not at 0,0.
+		x, y, width, height := "0", "0", "100%", "100%"
+		for _, attr := range svgAttrExp.FindAllSubmatch(svg[m[2]:m[3]], -1) {
+			if f := strings.Fields(string(attr[2])); string(attr[1]) == "viewBox" && len(f) == 4 {
+				x, y, width, height = f[0], f[1], f[2], f[3]
+			}
+		}
+		fmt.Fprintf(&b, `<rect x="%s" y="%s" width="%s" height="%s" fill="%s"/>`, x, y, width, height, html.EscapeString(bg))
+	}
+	b.Write(body)
+	b.Write(svg[m[5]:])
+	return b.Bytes(), nil
+}
@@ -0,0 +1,316 @@
+package latex
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Equation is a single LaTeX equation to be converted into an image.
+type Equation struct {
+	// Source is the LaTeX source of the equation.
+	Source string
+
+	// Inline indicates whether the equation appears in-line with text.
+	Inline bool
+
+	// Attrs are options for converting this equation only, such as
+	// "scale" or "color". See KnownAttrs.
+	Attrs map[string]string
+}
+
+// KnownAttrs are the per-equation attributes that may be set on a
+// render-latex block and are understood by tex2svg. The dpi attribute
+// only affects raster formats.
+var KnownAttrs = []string{"scale", "color", "dpi"}
+
+// attrArgs returns the equation's attributes as command-line flags,
+// sorted by name.
+func (eq *Equation) attrArgs() []string {
+	args := make([]string, 0, len(eq.Attrs))
+	for k, v := range eq.Attrs {
+		args = append(args, fmt.Sprintf("--%s=%s", k, v))
+	}
+	sort.Strings(args)
+	return args
+}
+
+// Converter converts a single LaTeX equation into an image.
+//
+// A Converter whose settings affect the images it produces should
+// also have a CacheKey() string method, returning a string that
+// identifies those settings, so that images kept in a CacheDir by a
+// differently configured Converter aren't reused.
+type Converter interface {
+	// Convert renders eq and writes the resulting image to w.
+	Convert(ctx context.Context, eq Equation, w io.Writer) error
+}
+
+// ConverterFunc is an adapter to allow the use of an ordinary
+// function as a Converter.
+type ConverterFunc func(ctx context.Context, eq Equation, w io.Writer) error
+
+// Convert calls f(ctx, eq, w).
+func (f ConverterFunc) Convert(ctx context.Context, eq Equation, w io.Writer) error {
+	return f(ctx, eq, w)
+}
+
+// ExecConverter is a Converter that invokes an external tex2svg-like
+// utility for each equation.
+type ExecConverter struct {
+	// Path is the location of the utility. If empty, the utility
+	// is expected to be called tex2svg and live in the same directory
+	// as the running binary.
+	Path string
+
+	// Format is the image format to request. If empty or "svg",
+	// no format is requested, and the utility is expected to
+	// produce SVG. Otherwise, it is passed via a --format flag.
+	// The bundled tex2svg supports png and pdf if rsvg-convert is
+	// installed.
+	Format string
+
+	// DPI, if positive, is the resolution to request of raster
+	// formats, passed via a --dpi flag, unless the equation sets its
+	// own with a dpi attribute. It is ignored for SVG.
+	DPI int
+
+	// Packages, if non-empty, restricts the TeX packages loaded by
+	// the utility to this list. By default, tex2svg loads all the
+	// packages MathJax provides, including mhchem for \ce{...}.
+	Packages []string
+
+	// Dir, if non-empty, is the working directory of the utility,
+	// against which any relative paths in equations are resolved.
+	Dir string
+
+	// Log, if non-nil, receives the command line of each invocation
+	// of the utility.
+	Log io.Writer
+}
+
+func (c *ExecConverter) path() string {
+	if c.Path == "" {
+		return filepath.Join(filepath.Dir(os.Args[0]), "tex2svg")
+	}
+	return c.Path
+}
+
+// Check verifies that the utility exists and is executable, returning
+// a descriptive error if not. A Path without any path separators is
+// looked up in PATH.
+func (c *ExecConverter) Check() error {
+	cvtPath := c.path()
+	if !strings.ContainsRune(cvtPath, filepath.Separator) && !strings.ContainsRune(cvtPath, '/') {
+		if _, err := exec.LookPath(cvtPath); err != nil {
+			return fmt.Errorf("%s not found in PATH; set -tex2svg or place it next to the binary", cvtPath)
+		}
+		return c.checkFormat()
+	}
+	fi, err := os.Stat(cvtPath)
+	if err != nil {
+		return fmt.Errorf("tex2svg not found at %s; set -tex2svg or place it next to the binary", cvtPath)
+	}
+	if fi.IsDir() || fi.Mode()&0o111 == 0 {
+		return fmt.Errorf("tex2svg at %s is not executable", cvtPath)
+	}
+	return c.checkFormat()
+}
+
+// checkFormat verifies that the bundled tex2svg can produce Format,
+// which for raster formats requires rsvg-convert. Other utilities are
+// trusted to know their own formats.
+func (c *ExecConverter) checkFormat() error {
+	if filepath.Base(c.path()) != "tex2svg" {
+		return nil
+	}
+	switch c.Format {
+	case "", "svg":
+		return nil
+	case "png", "pdf":
+		if _, err := exec.LookPath("rsvg-convert"); err != nil {
+			return fmt.Errorf("tex2svg requires rsvg-convert in PATH to produce %s images", c.Format)
+		}
+		return nil
+	case "webp":
+		return fmt.Errorf("tex2svg can't produce webp images; set -cwebp to convert png images with cwebp")
+	}
+	return fmt.Errorf("tex2svg can't produce %s images", c.Format)
+}
+
+func (c *ExecConverter) format() string {
+	if c.Format == "" {
+		return "svg"
+	}
+	return c.Format
+}
+
+// CacheKey identifies the utility and the settings it's invoked with.
+func (c *ExecConverter) CacheKey() string {
+	return fmt.Sprintf("exec %q %s %d %q %q", c.Path, c.format(), c.DPI, c.Packages, c.Dir)
+}
+
+// Convert implements Converter.
+func (c *ExecConverter) Convert(ctx context.Context, eq Equation, w io.Writer) error {
+	cvtPath := c.path()
+	args := []string{fmt.Sprintf("--inline=%t", eq.Inline)}
+	if c.Format != "" && c.Format != "svg" {
+		args = append(args, "--format="+c.Format)
+		if _, ok := eq.Attrs["dpi"]; c.DPI > 0 && !ok {
+			args = append(args, fmt.Sprintf("--dpi=%d", c.DPI))
+		}
+	}
+	if len(c.Packages) != 0 {
+		args = append(args, "--packages="+strings.Join(c.Packages, ","))
+	}
+	args = append(args, eq.attrArgs()...)
+	if c.Dir != "" && strings.ContainsRune(cvtPath, filepath.Separator) {
+		// Keep a relative path relative to our working directory.
+		abs, err := filepath.Abs(cvtPath)
+		if err != nil {
+			return err
+		}
+		cvtPath = abs
+	}
+	cmd := exec.CommandContext(ctx, cvtPath, append(args, eq.Source)...)
+	cmd.Dir = c.Dir
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if c.Log != nil {
+		fmt.Fprintf(c.Log, "exec: %q\n", cmd.Args)
+	}
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// WebPConverter is a Converter that converts the PNG images produced
+// by another Converter into WebP images using the cwebp utility, for
+// converters that can't produce WebP themselves.
+type WebPConverter struct {
+	// Converter produces the PNG images to convert. An ExecConverter
+	// must have its Format set to "png".
+	Converter Converter
+
+	// Path is the location of cwebp. If empty, cwebp is looked up
+	// in PATH.
+	Path string
+}
+
+func (c *WebPConverter) path() string {
+	if c.Path == "" {
+		return "cwebp"
+	}
+	return c.Path
+}
+
+// Check verifies that cwebp exists and that the underlying Converter,
+// if it has a Check method, can produce PNG images.
+func (c *WebPConverter) Check() error {
+	if _, err := exec.LookPath(c.path()); err != nil {
+		return fmt.Errorf("cwebp not found: %v", err)
+	}
+	if ec, ok := c.Converter.(*ExecConverter); ok && ec.Format != "png" {
+		return fmt.Errorf("converting to webp requires png images, not %s", ec.format())
+	}
+	if checker, ok := c.Converter.(interface{ Check() error }); ok {
+		return checker.Check()
+	}
+	return nil
+}
+
+// CacheKey identifies cwebp and the underlying Converter.
+func (c *WebPConverter) CacheKey() string {
+	key := ""
+	if k, ok := c.Converter.(interface{ CacheKey() string }); ok {
+		key = k.CacheKey()
+	}
+	return fmt.Sprintf("cwebp %q %s", c.Path, key)
+}
+
+// Convert implements Converter.
+func (c *WebPConverter) Convert(ctx context.Context, eq Equation, w io.Writer) error {
+	// cwebp can't read from a pipe, so go through temporary files.
+	dir, err := ioutil.TempDir("", "md-latex")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	pngPath, webpPath := filepath.Join(dir, "in.png"), filepath.Join(dir, "out.webp")
+	png, err := os.Create(pngPath)
+	if err != nil {
+		return err
+	}
+	err = c.Converter.Convert(ctx, eq, png)
+	if cerr := png.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, c.path(), "-quiet", pngPath, "-o", webpPath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("cwebp: %v: %s", err, msg)
+		}
+		return fmt.Errorf("cwebp: %v", err)
+	}
+	webp, err := ioutil.ReadFile(webpPath)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(webp)
+	return err
+}
+
+// SelfTest checks that c works by converting a trivial equation and
+// verifying that the result is an image in format, or SVG if format is
+// empty.
+func SelfTest(ctx context.Context, c Converter, format string) error {
+	if format == "" {
+		format = "svg"
+	}
+	var buf bytes.Buffer
+	if err := c.Convert(ctx, Equation{Source: "x^2"}, &buf); err != nil {
+		return fmt.Errorf("converting x^2: %v", err)
+	}
+	switch got := sniffFormat(buf.Bytes()); {
+	case got == "" || got == "svg" && !svgRootExp.Match(buf.Bytes()):
+		return fmt.Errorf("converting x^2: output is not a %s image: %.100q", format, buf.String())
+	case got != format:
+		return fmt.Errorf("converting x^2: output is a %s image, not %s", got, format)
+	}
+	return nil
+}
+
+// sniffFormat returns the image format that b, the first bytes of an
+// image, appears to be in, or the empty string if it's unrecognized.
+func sniffFormat(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(b, []byte("%PDF-")):
+		return "pdf"
+	case len(b) >= 12 && bytes.HasPrefix(b, []byte("RIFF")) && string(b[8:12]) == "WEBP":
+		return "webp"
+	}
+	b = bytes.TrimLeft(b, " \t\r\n")
+	if bytes.HasPrefix(b, []byte("<?xml")) || bytes.HasPrefix(b, []byte("<svg")) {
+		return "svg"
+	}
+	return ""
+}
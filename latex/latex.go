@@ -0,0 +1,1241 @@
+// Package latex renders LaTeX embedded in markdown documents into images
+// and rewrites the document to reference them.
+package latex
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Options configures Render.
+type Options struct {
+	// Tex2SVGPath is the location of the tex2svg utility. If empty,
+	// the utility is expected to live in the same directory as the
+	// running binary.
+	Tex2SVGPath string
+
+	// ImgDir is the directory to generate images to.
+	ImgDir string
+
+	// OutDir is the directory the rendered document will live in.
+	// Image references are emitted relative to this directory.
+	// If empty, ImgDir is used.
+	OutDir string
+
+	// Format is the image format to generate, and is used as the
+	// file extension for generated images. If empty, "svg" is used.
+	Format string
+
+	// DPI, if positive, is the resolution of raster images, in dots
+	// per inch, such as 192 for images twice the usual size. It is
+	// passed to the default Converter. It doesn't apply to SVG images.
+	DPI int
+
+	// RewriteBase, if set, rewrites image references beginning with
+	// RewriteBase[0] to begin with RewriteBase[1] instead, for example
+	// to point them at where the images are deployed.
+	RewriteBase [2]string
+
+	// Prefix, if non-empty, namespaces the generated images, so that
+	// several documents can share one ImgDir. It is prepended to the
+	// name of each generated file, separated by a dash, and to the
+	// alt text of each block equation, separated by a space.
+	Prefix string
+
+	// Preamble, if non-empty, is TeX prepended to the source of every
+	// equation passed to the Converter, such as shared macro
+	// definitions.
+	Preamble string
+
+	// Background, if non-empty, sets the background of each SVG image
+	// to a color, by replacing any background rectangle the Converter
+	// drew with one of that color. If it is "transparent", the
+	// background rectangle is removed instead.
+	Background string
+
+	// Converter converts each equation into an image. If nil, an
+	// ExecConverter is used with Tex2SVGPath and Format.
+	Converter Converter
+
+	// InlineDelims are the strings that open and close inline
+	// equations. If unset, inline equations are written `$...$`.
+	InlineDelims [2]string
+
+	// Figure, if true, emits block equations as an HTML figure
+	// with a numbered caption and an anchor id of the form eqn-N,
+	// rather than as a bare markdown image.
+	Figure bool
+
+	// EqnLabel is a text/template for the label of each block
+	// equation, used as its alt text and caption. The template is
+	// executed with a value whose Num field is the equation number,
+	// and whose Chapter field is Chapter. If empty,
+	// "Equation {{.Num}}" is used.
+	EqnLabel string
+
+	// InlineTemplate and BlockTemplate, if set, are text/templates
+	// for the markup referencing the image of each inline and block
+	// equation, overriding the other options that choose it. They
+	// are executed with a value whose Ref field is the reference to
+	// the image, Alt is its alt text, Width and Height are its size
+	// as given by an SVG image, or in pixels for a PNG image, and Num
+	// is the number of a numbered block equation. The template must
+	// escape the fields itself, e.g. with {{html .Alt}}.
+	InlineTemplate string
+	BlockTemplate  string
+
+	// NumberLabeled, if true, numbers only the block equations that
+	// contain a \label, like LaTeX's equation environment with every
+	// other equation marked \notag. Unnumbered block equations use
+	// their source as alt text.
+	NumberLabeled bool
+
+	// Chapter is made available to EqnLabel, for labels like
+	// "{{.Chapter}}.{{.Num}}".
+	Chapter string
+
+	// Native, if true, generates no images, and instead rewrites
+	// equations into the $$...$$ and $...$ math syntax that GitHub
+	// renders natively.
+	Native bool
+
+	// Sprite, if true, packs all the generated SVG images into a
+	// single sprite file of <symbol> elements in ImgDir, and references
+	// each with an inline <svg> element. It requires the svg Format.
+	Sprite bool
+
+	// Center, if true, wraps each block equation in a centered
+	// <div> element.
+	Center bool
+
+	// VAlign, if set, is the vertical alignment of inline equation
+	// images relative to the text baseline, a CSS length like
+	// "-0.3ex", or "auto" to take it from each SVG image generated.
+	// Inline equations are then referenced with HTML <img> tags
+	// with a style attribute setting it.
+	VAlign string
+
+	// Srcset, if true, also generates each raster image at twice the
+	// resolution, with "@2x" added to its name, and references both
+	// with HTML <img> tags with a srcset attribute, for high density
+	// displays. The Converter must honor the dpi attribute, as
+	// ExecConverter does with the bundled tex2svg.
+	Srcset bool
+
+	// InlineDataURI, if true, embeds the image of each inline equation
+	// in the document as a data URI, rather than generating a file for
+	// it. Block equations are unaffected. It is ignored in Sprite mode.
+	InlineDataURI bool
+
+	// InlineHTML and BlockHTML, if true, emit references to inline
+	// and block equation images respectively as HTML <img> tags rather
+	// than markdown images.
+	InlineHTML bool
+	BlockHTML  bool
+
+	// EscapeAlt, if true, escapes characters in the alt text of
+	// markdown image references that markdown would otherwise interpret,
+	// such as the underscores in a label like "eq_1".
+	EscapeAlt bool
+
+	// EmbedSource, if true, emits an HTML comment containing the
+	// source of each equation next to its image reference.
+	EmbedSource bool
+
+	// SourceMap, if true, emits an HTML comment before each image
+	// reference giving the lines of the input the equation came from,
+	// like <!-- src: lines 42-48 -->.
+	SourceMap bool
+
+	// KeepTeX, if true, writes the exact input passed to the Converter
+	// for each image to a .tex file next to the image, for debugging.
+	KeepTeX bool
+
+	// SkipUnchanged, if true, leaves alone any file that would be
+	// generated but already exists with the same contents, rather
+	// than rewriting it and updating its modification time.
+	SkipUnchanged bool
+
+	// NoInlineCache and NoBlockCache, if true, generate a new image for
+	// every inline and block equation respectively, rather than reusing
+	// the image of an identical equation earlier in the document.
+	NoInlineCache bool
+	NoBlockCache  bool
+
+	// Cache, if non-nil, is used to reuse images across calls to
+	// Render that share it. Otherwise, images are only reused within
+	// a document.
+	Cache *Cache
+
+	// CacheDir, if non-empty, is a directory in which the output of
+	// the Converter for each equation is kept across runs, named by a
+	// hash of the equation and the options affecting its image.
+	// Equations found there aren't converted again. It's safe for
+	// several runs to share it concurrently.
+	CacheDir string
+
+	// CacheMiss, if non-nil, is called with a description of each
+	// equation that wasn't found in CacheDir, once it has been
+	// converted and added there.
+	CacheMiss func(desc string)
+
+	// MaxEquationBytes, if positive, is the largest equation source,
+	// in bytes, to pass to the Converter. Rendering a larger equation
+	// fails.
+	MaxEquationBytes int
+
+	// Created, if non-nil, is called with the path of each file
+	// created in ImgDir.
+	Created func(path string)
+
+	// Progress, if non-nil, is called as each equation is rendered
+	// with the number of equations rendered so far, including that
+	// one, and the total number of equations in the document.
+	Progress func(done, total int)
+
+	// Log, if non-nil, receives diagnostic messages about the
+	// rendering process, at the level of detail set by Verbosity.
+	Log io.Writer
+
+	// Verbosity controls how much is written to Log. At 1, each
+	// equation and whether it was found in the cache is logged.
+	// At 2, the time taken to convert each equation is also logged.
+	Verbosity int
+}
+
+// logf writes a diagnostic message to o.Log if the verbosity
+// is at least level.
+func (o *Options) logf(level int, format string, args ...interface{}) {
+	if o.Log == nil || o.Verbosity < level {
+		return
+	}
+	fmt.Fprintf(o.Log, format+"\n", args...)
+}
+
+func (o *Options) format() string {
+	if o.Format == "" {
+		return "svg"
+	}
+	return o.Format
+}
+
+// defaultDPI is the resolution assumed for raster images when DPI is
+// unset.
+const defaultDPI = 96
+
+func (o *Options) dpi() int {
+	if o.DPI > 0 {
+		return o.DPI
+	}
+	return defaultDPI
+}
+
+func (o *Options) inlineDelims() (open, close string) {
+	if o.InlineDelims == [2]string{} {
+		return "`$", "$`"
+	}
+	return o.InlineDelims[0], o.InlineDelims[1]
+}
+
+// inlineSpan is the location of an inline equation in a line.
+// line[start:end] is the whole equation including its delimiters,
+// and line[srcStart:srcEnd] is its source.
+type inlineSpan struct {
+	start, end       int
+	srcStart, srcEnd int
+}
+
+// findInline returns the inline equations in line delimited by open
+// and close. Delimiters within a code span quoted by two or more
+// backticks don't count, since they can only be literal text.
+func findInline(line, open, close string) []inlineSpan {
+	var spans []inlineSpan
+	codeSpans := longCodeSpans(line)
+	for off := 0; ; {
+		i := strings.Index(line[off:], open)
+		if i < 0 {
+			return spans
+		}
+		if end := spanEnd(codeSpans, off+i); end >= 0 {
+			off = end
+			continue
+		}
+		sp := inlineSpan{start: off + i, srcStart: off + i + len(open)}
+		j := strings.Index(line[sp.srcStart:], close)
+		if j < 0 {
+			return spans
+		}
+		sp.srcEnd = sp.srcStart + j
+		sp.end = sp.srcEnd + len(close)
+		spans = append(spans, sp)
+		off = sp.end
+	}
+}
+
+// longCodeSpans returns the start and end offsets of each code span in
+// line quoted by runs of more than one backtick.
+func longCodeSpans(line string) [][2]int {
+	if !strings.Contains(line, "``") {
+		return nil
+	}
+	var spans [][2]int
+	for i := 0; i < len(line); {
+		if line[i] != '`' {
+			i++
+			continue
+		}
+		n := backtickRun(line[i:])
+		// Find the next run of the same length, which closes the span.
+		end := -1
+		for j := i + n; j < len(line); {
+			if line[j] != '`' {
+				j++
+				continue
+			}
+			m := backtickRun(line[j:])
+			if m == n {
+				end = j + m
+				break
+			}
+			j += m
+		}
+		if end < 0 {
+			i += n
+			continue
+		}
+		if n > 1 {
+			spans = append(spans, [2]int{i, end})
+		}
+		i = end
+	}
+	return spans
+}
+
+// backtickRun returns the number of backticks s begins with.
+func backtickRun(s string) int {
+	n := 0
+	for n < len(s) && s[n] == '`' {
+		n++
+	}
+	return n
+}
+
+// spanEnd returns the end of the span in spans containing offset i,
+// or -1 if there is none.
+func spanEnd(spans [][2]int, i int) int {
+	for _, sp := range spans {
+		if sp[0] <= i && i < sp[1] {
+			return sp[1]
+		}
+	}
+	return -1
+}
+
+// codeFence returns the fence that line, with its indentation removed,
+// begins with, such as "```" or "~~~~", or the empty string if it
+// doesn't begin with one.
+func codeFence(line string) string {
+	if !strings.HasPrefix(line, "```") && !strings.HasPrefix(line, "~~~") {
+		return ""
+	}
+	n := 0
+	for n < len(line) && line[n] == line[0] {
+		n++
+	}
+	return line[:n]
+}
+
+// closesFence reports whether line, with its indentation removed,
+// closes the code block opened by fence.
+func closesFence(line, fence string) bool {
+	f := codeFence(line)
+	return f != "" && f[0] == fence[0] && len(f) >= len(fence) && strings.TrimSpace(line[len(f):]) == ""
+}
+
+// labelExp matches a \label command in the source of an equation.
+var labelExp = regexp.MustCompile(`\\label\s*\{`)
+
+var generatedNameExp = regexp.MustCompile(`^(eqn|inl)[0-9]+(@2x)?\.[A-Za-z0-9]+$`)
+
+// IsGeneratedName reports whether name is a file name that Render
+// might generate in an image directory with the given Prefix.
+func IsGeneratedName(prefix, name string) bool {
+	if prefix != "" {
+		if !strings.HasPrefix(name, prefix+"-") {
+			return false
+		}
+		name = name[len(prefix)+1:]
+	}
+	return generatedNameExp.MatchString(name)
+}
+
+// fileName returns the name of a generated file, with o.Prefix.
+func (o *Options) fileName(name string) string {
+	if o.Prefix == "" {
+		return name
+	}
+	return o.Prefix + "-" + name
+}
+
+// Render reads a markdown document from in, generates images for
+// each LaTeX block and inline LaTeX snippet, and writes the document
+// with the LaTeX replaced by image references to out.
+func Render(in io.Reader, out io.Writer, opts Options) error {
+	return RenderContext(context.Background(), in, out, opts)
+}
+
+// RenderContext is like Render, but passes ctx to the Converter.
+func RenderContext(ctx context.Context, in io.Reader, out io.Writer, opts Options) error {
+	if opts.OutDir == "" {
+		opts.OutDir = opts.ImgDir
+	}
+	if opts.Converter == nil {
+		opts.Converter = &ExecConverter{Path: opts.Tex2SVGPath, Format: opts.Format, DPI: opts.DPI}
+	}
+	if opts.Srcset && opts.format() == "svg" && !opts.Native {
+		return fmt.Errorf("srcset requires a raster format, not svg")
+	}
+	if opts.Sprite && opts.format() != "svg" && !opts.Native {
+		return fmt.Errorf("a sprite can only hold svg images, not %s", opts.format())
+	}
+	if opts.VAlign != "" && opts.VAlign != "auto" && !cssLengthExp.MatchString(opts.VAlign) {
+		return fmt.Errorf("vertical alignment %q is not auto or a CSS length like -0.3ex", opts.VAlign)
+	}
+	if opts.VAlign == "auto" && opts.format() != "svg" && !opts.Native {
+		opts.logf(0, "warning: vertical alignment can only be computed for svg images, not %s", opts.format())
+	}
+	if opts.DPI > 0 && opts.format() == "svg" {
+		opts.logf(0, "warning: ignoring DPI %d for svg images", opts.DPI)
+		opts.DPI = 0
+	}
+	if opts.Background != "" && !opts.Native {
+		if opts.format() != "svg" {
+			return fmt.Errorf("a background can only be set for svg images, not %s", opts.format())
+		}
+		opts.Converter = backgroundConverter(opts.Converter, opts.Background)
+	}
+	r, err := newRenderer(&opts)
+	if err != nil {
+		return err
+	}
+	if opts.Progress != nil {
+		// Read ahead to count the equations.
+		b, err := ioutil.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		r.total = countEquations(b, &opts)
+		in = bytes.NewReader(b)
+	}
+	open, close := opts.inlineDelims()
+	s := newLineReader(in)
+	var tables tableTracker
+	consumeEqn := false
+	var mathBuf strings.Builder
+	var info string // rest of the info string of the block's fence
+	var attrs map[string]string
+	var outName string
+	var fence string // fence of the code block being passed through
+	lineNum, eqnStart := 0, 0
+	for s.Scan() {
+		lineNum++
+		line := s.Text()
+		trimmedLine := strings.TrimSpace(line)
+		if consumeEqn {
+			if trimmedLine == "```" && opts.Native {
+				fmt.Fprintf(out, "$$\n%s$$\n", mathBuf.String())
+				mathBuf.Reset()
+				consumeEqn = false
+			} else if trimmedLine == "```" {
+				img, err := r.createSVG(ctx, Equation{Source: mathBuf.String(), Attrs: attrs}, outName)
+				if err != nil {
+					return err
+				}
+				if opts.SourceMap {
+					fmt.Fprintf(out, "<!-- src: lines %d-%d -->\n", eqnStart, lineNum)
+				}
+				if opts.EmbedSource {
+					fmt.Fprintln(out, sourceComment(mathBuf.String(), info, false))
+				}
+				var ref string
+				switch {
+				case r.blockTmpl != nil:
+					if ref, err = r.markup(r.blockTmpl, img); err != nil {
+						return err
+					}
+				case opts.Figure:
+					ref = img.figure()
+				case opts.BlockHTML || opts.Sprite || opts.Srcset:
+					ref = img.html()
+				default:
+					// Markdown within an HTML block must be
+					// set off by blank lines.
+					ref = img.markdown(opts.EscapeAlt)
+					if opts.Center {
+						ref = "\n" + ref + "\n"
+					}
+				}
+				if opts.Center {
+					ref = "<div align=\"center\">\n" + ref + "\n</div>"
+				}
+				fmt.Fprintln(out, ref)
+				mathBuf.Reset()
+				consumeEqn = false
+			} else {
+				mathBuf.WriteString(line)
+				mathBuf.WriteString("\n")
+			}
+		} else {
+			inTable := tables.row(line, s.Peek())
+			if fence != "" {
+				// Leave the contents of code blocks alone.
+				if closesFence(trimmedLine, fence) {
+					fence = ""
+				}
+				fmt.Fprintln(out, line)
+			} else if fenceInfo, ok := renderLatexFence(trimmedLine); ok {
+				var err error
+				info = fenceInfo
+				attrs, outName, err = parseAttrs(info, &opts, lineNum)
+				if err != nil {
+					return err
+				}
+				consumeEqn = true
+				eqnStart = lineNum
+			} else if fence = codeFence(trimmedLine); fence != "" {
+				fmt.Fprintln(out, line)
+			} else if spans := findInline(line, open, close); len(spans) > 0 {
+				var newLine strings.Builder
+				lastIdx := 0
+				for _, sp := range spans {
+					newLine.WriteString(line[lastIdx:sp.start])
+					lastIdx = sp.end
+					src := line[sp.srcStart:sp.srcEnd]
+					if opts.Native {
+						newLine.WriteString("$" + src + "$")
+						continue
+					}
+					img, err := r.createSVG(ctx, Equation{Source: src, Inline: true}, "")
+					if err != nil {
+						return err
+					}
+					if opts.SourceMap {
+						fmt.Fprintf(&newLine, "<!-- src: line %d -->", lineNum)
+					}
+					var ref, comment string
+					if r.inlineTmpl != nil {
+						if ref, err = r.markup(r.inlineTmpl, img); err != nil {
+							return err
+						}
+					} else if opts.InlineHTML || opts.Sprite || opts.Srcset || opts.VAlign != "" {
+						ref = img.html()
+					} else {
+						ref = img.markdown(opts.EscapeAlt)
+					}
+					if opts.EmbedSource {
+						comment = sourceComment(src, "", true)
+					}
+					if inTable {
+						ref, comment = pipeEscaper.Replace(ref), pipeEscaper.Replace(comment)
+					}
+					newLine.WriteString(ref + comment)
+				}
+				newLine.WriteString(line[lastIdx:])
+				fmt.Fprintln(out, newLine.String())
+			} else {
+				fmt.Fprintln(out, line)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if consumeEqn {
+		return fmt.Errorf("line %d: unterminated render-latex block", eqnStart)
+	}
+	if opts.Sprite {
+		return r.writeSprite()
+	}
+	return nil
+}
+
+// countEquations returns the number of equations in the document src.
+func countEquations(src []byte, opts *Options) int {
+	open, close := opts.inlineDelims()
+	n := 0
+	inEqn := false
+	fence := ""
+	s := bufio.NewScanner(bytes.NewReader(src))
+	for s.Scan() {
+		trimmedLine := strings.TrimSpace(s.Text())
+		if inEqn {
+			inEqn = trimmedLine != "```"
+		} else if fence != "" {
+			if closesFence(trimmedLine, fence) {
+				fence = ""
+			}
+		} else if _, ok := renderLatexFence(trimmedLine); ok {
+			inEqn = true
+			n++
+		} else if fence = codeFence(trimmedLine); fence == "" {
+			n += len(findInline(s.Text(), open, close))
+		}
+	}
+	return n
+}
+
+// renderLatexFence reports whether line opens a render-latex block,
+// and if so, returns the rest of the fence's info string.
+func renderLatexFence(line string) (string, bool) {
+	const fence = "```render-latex"
+	if !strings.HasPrefix(line, fence) {
+		return "", false
+	}
+	info := line[len(fence):]
+	if info != "" && info[0] != ' ' && info[0] != '\t' && info[0] != '{' {
+		return "", false
+	}
+	return info, true
+}
+
+// parseAttrs parses the attributes of a render-latex block from the
+// remainder of its fence's info string, which may be of the form
+//
+//	{scale=1.5 color=blue}
+//
+// or the same without braces. Attributes other than KnownAttrs are
+// dropped with a warning, except for out, which names the image file
+// to generate for the block, and is returned separately.
+func parseAttrs(info string, opts *Options, lineNum int) (attrs map[string]string, out string, err error) {
+	info = strings.TrimSpace(info)
+	if strings.HasPrefix(info, "{") && strings.HasSuffix(info, "}") {
+		info = info[1 : len(info)-1]
+	}
+	fields := strings.Fields(info)
+	if len(fields) == 0 {
+		return nil, "", nil
+	}
+	attrs = make(map[string]string)
+	for _, field := range fields {
+		i := strings.IndexByte(field, '=')
+		if i <= 0 {
+			return nil, "", fmt.Errorf("line %d: malformed render-latex attribute %q", lineNum, field)
+		}
+		key, value := field[:i], field[i+1:]
+		if key == "out" {
+			out, err = outName(value, opts)
+			if err != nil {
+				return nil, "", fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			continue
+		}
+		if !isKnownAttr(key) {
+			opts.logf(0, "line %d: warning: ignoring unknown render-latex attribute %q", lineNum, key)
+			continue
+		}
+		attrs[key] = value
+	}
+	return attrs, out, nil
+}
+
+// outName validates the file name given by an out attribute, adding
+// the image format's extension if it has none.
+func outName(name string, opts *Options) (string, error) {
+	switch ext := filepath.Ext(name); {
+	case name == "" || strings.ContainsAny(name, `/\`):
+		return "", fmt.Errorf("invalid output name %q", name)
+	case generatedNameExp.MatchString(name):
+		return "", fmt.Errorf("output name %q may collide with generated names", name)
+	case ext == "":
+		name += "." + opts.format()
+	case ext != "."+opts.format():
+		return "", fmt.Errorf("output name %q doesn't have the extension .%s", name, opts.format())
+	}
+	return name, nil
+}
+
+func isKnownAttr(key string) bool {
+	for _, k := range KnownAttrs {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceEscaper escapes equation source for inclusion in an HTML
+// comment. Because "&" is always escaped, the escaping is reversible.
+var sourceEscaper = strings.NewReplacer("&", "&amp;", "--", "&#45;&#45;")
+
+// sourceComment returns an HTML comment containing the equation eq,
+// escaped such that the equation cannot terminate the comment early.
+// The comment for a block equation also records the rest of the info
+// string of its fence verbatim, so that Strip can restore it.
+func sourceComment(eq, info string, inline bool) string {
+	if inline {
+		return fmt.Sprintf("<!-- latex: %s -->", sourceEscaper.Replace(eq))
+	}
+	return fmt.Sprintf("<!-- latex%s:\n%s-->", sourceEscaper.Replace(info), sourceEscaper.Replace(eq))
+}
+
+// image describes a generated equation image.
+type image struct {
+	alt string // alt text
+	ref string // path of the image relative to the output directory
+	num int    // equation number, only set for numbered block equations
+
+	// sprite is set if ref refers to a symbol in a sprite, and
+	// svgAttrs holds the display attributes for referencing it.
+	sprite   bool
+	svgAttrs string
+
+	srcset string // srcset of the image, if it has variants
+	valign string // vertical alignment of the image, if set
+
+	// width and height are the size of the image, if known.
+	width, height string
+}
+
+// markdown returns a markdown reference to the image. If escape is
+// set, characters in the alt text that markdown would interpret are
+// escaped.
+func (img image) markdown(escape bool) string {
+	alt := img.alt
+	if escape {
+		alt = escapeMarkdown(alt)
+	}
+	return fmt.Sprintf("![%s](%s)", alt, img.ref)
+}
+
+// escapeMarkdown backslash-escapes the characters in s that markdown
+// may interpret as emphasis or links, except within code spans, where
+// backslash escapes aren't interpreted.
+func escapeMarkdown(s string) string {
+	var b strings.Builder
+	inCode := false
+	for _, r := range s {
+		switch {
+		case r == '`':
+			inCode = !inCode
+		case inCode:
+		case strings.ContainsRune(`\_*[]`, r):
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// html returns an HTML <img> tag referencing the image, or an <svg>
+// element referencing the image's symbol in a sprite.
+func (img image) html() string {
+	if img.sprite {
+		return fmt.Sprintf("<svg role=\"img\" aria-label=\"%s\"%s><use href=\"%s\"/></svg>",
+			html.EscapeString(img.alt), img.svgAttrs, html.EscapeString(img.ref))
+	}
+	srcset := ""
+	if img.srcset != "" {
+		srcset = fmt.Sprintf(" srcset=\"%s\"", html.EscapeString(img.srcset))
+	}
+	style := ""
+	if img.valign != "" {
+		style = fmt.Sprintf(" style=\"vertical-align: %s\"", html.EscapeString(img.valign))
+	}
+	return fmt.Sprintf("<img src=\"%s\"%s alt=\"%s\"%s>", html.EscapeString(img.ref), srcset, html.EscapeString(img.alt), style)
+}
+
+// figure returns an HTML figure containing the image, captioned
+// with its alt text and anchored by equation number. The figure of
+// an unnumbered equation has neither.
+func (img image) figure() string {
+	if img.num == 0 {
+		return fmt.Sprintf("<figure>\n%s\n</figure>", img.html())
+	}
+	return fmt.Sprintf("<figure id=\"eqn-%d\">\n%s\n<figcaption>%s</figcaption>\n</figure>",
+		img.num, img.html(), html.EscapeString(img.alt))
+}
+
+// Cache records the images generated by Render, so that an equation
+// identical to one already rendered reuses its image. Sharing a Cache
+// between calls to Render extends this across documents, as long as
+// the images they generate are kept in place.
+type Cache struct {
+	// images maps the cacheKey of each equation rendered so far
+	// to its image.
+	images map[string]cachedImage
+
+	// names maps the names of the image files given by out
+	// attributes to the cacheKey of the equation they hold.
+	names map[string]string
+}
+
+// NewCache returns an empty Cache.
+func NewCache() *Cache {
+	return &Cache{images: make(map[string]cachedImage), names: make(map[string]string)}
+}
+
+// cachedImage is an image in a Cache.
+type cachedImage struct {
+	path     string // path of the image, or of the sprite containing it
+	fragment string // fragment identifying the image in its sprite
+	sprite   bool
+	svgAttrs string
+	dataURI  string // the image as a data URI, instead of path
+	path2x   string // path of the image at twice the resolution, for srcset
+	valign   string
+	width    string
+	height   string
+}
+
+// renderer holds the state of a single Render call.
+type renderer struct {
+	opts *Options
+
+	cache *Cache
+
+	// symbols are the images in the sprite, in sprite mode.
+	symbols []symbol
+
+	// Numbers of the next inline and block equation image, and of
+	// the next numbered block equation.
+	numInline int
+	numBlock  int
+	numEqn    int
+
+	// Number of equations rendered so far, and in total, for
+	// Options.Progress.
+	done, total int
+
+	eqnLabel *template.Template
+
+	// inlineTmpl and blockTmpl are the parsed InlineTemplate and
+	// BlockTemplate, or nil if unset.
+	inlineTmpl, blockTmpl *template.Template
+}
+
+func (r *renderer) created(path string) {
+	if r.opts.Created != nil {
+		r.opts.Created(path)
+	}
+}
+
+// imageRef returns the reference to emit for the generated file at
+// path, relative to OutDir and rewritten according to RewriteBase.
+// The path is URL-encoded, so that names with spaces or other special
+// characters resolve.
+func (r *renderer) imageRef(path string) (string, error) {
+	ref, err := filepath.Rel(r.opts.OutDir, path)
+	if err != nil {
+		return "", err
+	}
+	ref = filepath.ToSlash(ref)
+	if old := r.opts.RewriteBase[0]; strings.HasPrefix(ref, old) {
+		return r.opts.RewriteBase[1] + escapePath(ref[len(old):]), nil
+	}
+	return escapePath(ref), nil
+}
+
+// escapePath URL-encodes each element of the slash-separated path p.
+func escapePath(p string) string {
+	elems := strings.Split(p, "/")
+	for i, e := range elems {
+		elems[i] = url.PathEscape(e)
+	}
+	return strings.Join(elems, "/")
+}
+
+// writeFile writes data to the file at path, which is reported as
+// created. If Options.SkipUnchanged is set and the file already holds
+// data, it is left untouched.
+func (r *renderer) writeFile(path string, data []byte) error {
+	if r.opts.SkipUnchanged {
+		if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, data) {
+			r.opts.logf(1, "%s is unchanged, keeping it", path)
+			r.created(path)
+			return nil
+		}
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	r.created(path)
+	return nil
+}
+
+// writeFileAtomic writes data to the file at path by way of a
+// temporary file in the same directory, so that path never holds a
+// partially written file, even if writing fails or is interrupted.
+func writeFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	f, err := ioutil.TempFile(dir, "."+name+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func newRenderer(opts *Options) (*renderer, error) {
+	if open, close := opts.inlineDelims(); open == "" || close == "" {
+		return nil, fmt.Errorf("inline equation delimiters must not be empty")
+	}
+	if strings.ContainsAny(opts.Prefix, `/\`) {
+		return nil, fmt.Errorf("prefix %q contains a path separator", opts.Prefix)
+	}
+	label := opts.EqnLabel
+	if label == "" {
+		label = "Equation {{.Num}}"
+	}
+	tmpl, err := template.New("eqn-label").Parse(label)
+	if err != nil {
+		return nil, err
+	}
+	cache := opts.Cache
+	if cache == nil {
+		cache = NewCache()
+	}
+	r := &renderer{
+		opts:      opts,
+		cache:     cache,
+		numInline: 1,
+		numBlock:  1,
+		numEqn:    1,
+		eqnLabel:  tmpl,
+	}
+	if opts.InlineTemplate != "" {
+		if r.inlineTmpl, err = template.New("inline-template").Parse(opts.InlineTemplate); err != nil {
+			return nil, err
+		}
+	}
+	if opts.BlockTemplate != "" {
+		if r.blockTmpl, err = template.New("block-template").Parse(opts.BlockTemplate); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// markup returns the markup referencing img, given by tmpl.
+func (r *renderer) markup(tmpl *template.Template, img image) (string, error) {
+	var b strings.Builder
+	err := tmpl.Execute(&b, struct {
+		Ref, Alt      string
+		Width, Height string
+		Num           int
+	}{img.ref, img.alt, img.width, img.height, img.num})
+	return b.String(), err
+}
+
+// label returns the label of block equation num.
+func (r *renderer) label(num int) (string, error) {
+	var b strings.Builder
+	err := r.eqnLabel.Execute(&b, struct {
+		Num     int
+		Chapter string
+	}{num, r.opts.Chapter})
+	return b.String(), err
+}
+
+// cacheKey returns a key identifying the image generated for eq
+// with the given options, which is the same for any two equations
+// that would produce identical images. It includes the Converter's
+// CacheKey, if it has one.
+func cacheKey(eq *Equation, opts *Options) string {
+	var cvtKey string
+	if k, ok := opts.Converter.(interface{ CacheKey() string }); ok {
+		cvtKey = k.CacheKey()
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%s\x00%t\x00%q\x00%s", cvtKey, opts.format(), opts.DPI, opts.Background, eq.Inline, eq.attrArgs(), eq.Source)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// createSVG generates the image for eq, named name if it's non-empty,
+// and returns a reference to it.
+func (r *renderer) createSVG(ctx context.Context, eq Equation, name string) (image, error) {
+	opts := r.opts
+	if opts.Progress != nil {
+		r.done++
+		opts.Progress(r.done, r.total)
+	}
+	var img image
+	var fname string
+	block := r.numBlock // the number of a block equation's image
+	if eq.Inline {
+		img.alt = fmt.Sprintf("`%s`", eq.Source)
+	} else if opts.NumberLabeled && !labelExp.MatchString(eq.Source) {
+		r.numBlock++
+		img.alt = fmt.Sprintf("`%s`", strings.Join(strings.Fields(eq.Source), " "))
+	} else {
+		r.numBlock++
+		img.num = r.numEqn
+		r.numEqn++
+		var err error
+		img.alt, err = r.label(img.num)
+		if err != nil {
+			return image{}, err
+		}
+		if opts.Prefix != "" {
+			img.alt = opts.Prefix + " " + img.alt
+		}
+	}
+	desc := fmt.Sprintf("equation %d", block)
+	if eq.Inline {
+		desc = fmt.Sprintf("inline equation %q", eq.Source)
+	}
+	if max := opts.MaxEquationBytes; max > 0 && len(eq.Source) > max {
+		if eq.Inline {
+			desc = fmt.Sprintf("inline equation %d", r.numInline)
+		}
+		return image{}, fmt.Errorf("%s is %d bytes long, more than the limit of %d", desc, len(eq.Source), max)
+	}
+	if opts.Preamble != "" {
+		// The converter sees the preamble as part of the equation.
+		eq.Source = strings.TrimSuffix(opts.Preamble, "\n") + "\n" + eq.Source
+	}
+	key := cacheKey(&eq, opts)
+	if name != "" {
+		if prev, ok := r.cache.names[name]; ok && prev != key {
+			return image{}, fmt.Errorf("%s: output name %q is already used by a different equation", desc, name)
+		}
+		r.cache.names[name] = key
+	}
+	noCache := opts.NoInlineCache && eq.Inline || opts.NoBlockCache && !eq.Inline || name != ""
+	dataURI := eq.Inline && opts.InlineDataURI && !opts.Sprite
+	if cached, ok := r.cache.images[key]; ok && !noCache && (cached.dataURI != "") == dataURI {
+		img.valign, img.width, img.height = cached.valign, cached.width, cached.height
+		if dataURI {
+			img.ref = cached.dataURI
+			opts.logf(1, "%s: cache hit", desc)
+			return img, nil
+		}
+		ref, err := r.imageRef(cached.path)
+		if err != nil {
+			return image{}, err
+		}
+		img.ref, img.sprite, img.svgAttrs = ref+cached.fragment, cached.sprite, cached.svgAttrs
+		if cached.path2x != "" {
+			if img.srcset, err = r.srcset(ref, cached.path2x); err != nil {
+				return image{}, err
+			}
+		}
+		opts.logf(1, "%s: cache hit, using %s", desc, img.ref)
+		return img, nil
+	}
+	if dataURI {
+		opts.logf(1, "%s: cache miss, rendering to a data URI", desc)
+		data, err := r.convert(ctx, eq, desc)
+		if err != nil {
+			return image{}, err
+		}
+		img.ref = "data:" + mime.TypeByExtension("."+opts.format()) + ";base64," + base64.StdEncoding.EncodeToString(data)
+		img.valign = r.valign(eq, data)
+		img.width, img.height = imageSize(data)
+		r.cache.images[key] = cachedImage{dataURI: img.ref, valign: img.valign, width: img.width, height: img.height}
+		return img, nil
+	}
+	if name != "" {
+		fname = name
+	} else if eq.Inline {
+		fname = opts.fileName(fmt.Sprintf("inl%d.%s", r.numInline, opts.format()))
+		r.numInline++
+	} else {
+		fname = opts.fileName(fmt.Sprintf("eqn%d.%s", block, opts.format()))
+	}
+	imgOutPath := filepath.Join(opts.ImgDir, fname)
+	opts.logf(1, "%s: cache miss, rendering to %s", desc, imgOutPath)
+	if opts.KeepTeX {
+		texPath := strings.TrimSuffix(imgOutPath, filepath.Ext(imgOutPath)) + ".tex"
+		if err := r.writeFile(texPath, []byte(eq.Source)); err != nil {
+			return image{}, err
+		}
+	}
+	if opts.Sprite {
+		data, err := r.convert(ctx, eq, desc)
+		if err != nil {
+			return image{}, err
+		}
+		id := strings.TrimSuffix(fname, filepath.Ext(fname))
+		attrs, err := r.addSymbol(id, data)
+		if err != nil {
+			return image{}, fmt.Errorf("%s: %v", desc, err)
+		}
+		ref, err := r.imageRef(r.spritePath())
+		if err != nil {
+			return image{}, err
+		}
+		img.ref, img.sprite, img.svgAttrs = ref+"#"+id, true, attrs
+		img.width, img.height = imageSize(data)
+		r.cache.images[key] = cachedImage{path: r.spritePath(), fragment: "#" + id, sprite: true, svgAttrs: attrs, width: img.width, height: img.height}
+		return img, nil
+	}
+	data, err := r.convert(ctx, eq, desc)
+	if err != nil {
+		return image{}, err
+	}
+	if err := r.writeFile(imgOutPath, data); err != nil {
+		return image{}, err
+	}
+	if got := sniffFormat(data); got != "" && got != opts.format() {
+		opts.logf(0, "warning: %s: converter produced %s, but %s has extension .%s", desc, got, imgOutPath, opts.format())
+	}
+	ref, err := r.imageRef(imgOutPath)
+	if err != nil {
+		return image{}, err
+	}
+	img.ref = ref
+	img.valign = r.valign(eq, data)
+	img.width, img.height = imageSize(data)
+	cached := cachedImage{path: imgOutPath, valign: img.valign, width: img.width, height: img.height}
+	if opts.Srcset {
+		// Also generate the image at twice the resolution.
+		eq2x := Equation{Source: eq.Source, Inline: eq.Inline, Attrs: map[string]string{"dpi": strconv.Itoa(2 * opts.dpi())}}
+		for k, v := range eq.Attrs {
+			eq2x.Attrs[k] = v
+		}
+		data2x, err := r.convert(ctx, eq2x, desc+" at 2x")
+		if err != nil {
+			return image{}, err
+		}
+		if bytes.Equal(data2x, data) {
+			return image{}, fmt.Errorf("%s: converter ignored the dpi attribute, which srcset requires", desc)
+		}
+		cached.path2x = path2x(imgOutPath)
+		if err := r.writeFile(cached.path2x, data2x); err != nil {
+			return image{}, err
+		}
+		if img.srcset, err = r.srcset(ref, cached.path2x); err != nil {
+			return image{}, err
+		}
+	}
+	r.cache.images[key] = cached
+	return img, nil
+}
+
+// cssLengthExp matches a CSS length, like "-0.3ex".
+var cssLengthExp = regexp.MustCompile(`^-?([0-9]+(\.[0-9]*)?|\.[0-9]+)(ex|em|rem|px|pt|%)$`)
+
+// svgVAlignExp matches the vertical alignment in the style of an SVG
+// image's root element, as MathJax sets it.
+var svgVAlignExp = regexp.MustCompile(`vertical-align:\s*([^;"]+)`)
+
+// valign returns the vertical alignment of the image data generated
+// for eq, according to the VAlign option.
+func (r *renderer) valign(eq Equation, data []byte) string {
+	switch {
+	case !eq.Inline:
+		return ""
+	case r.opts.VAlign != "auto":
+		return r.opts.VAlign
+	}
+	m := svgRootExp.FindSubmatch(data)
+	if m == nil {
+		return ""
+	}
+	for _, attr := range svgAttrExp.FindAllStringSubmatch(string(m[1]), -1) {
+		if attr[1] != "style" {
+			continue
+		}
+		if v := svgVAlignExp.FindStringSubmatch(attr[2]); v != nil {
+			return strings.TrimSpace(v[1])
+		}
+	}
+	return ""
+}
+
+// imageSize returns the width and height of the image data, as given
+// by the root element of an SVG image, or in pixels for a PNG image.
+// They are empty if unknown.
+func imageSize(data []byte) (width, height string) {
+	if m := svgRootExp.FindSubmatch(data); m != nil {
+		for _, attr := range svgAttrExp.FindAllStringSubmatch(string(m[1]), -1) {
+			switch attr[1] {
+			case "width":
+				width = attr[2]
+			case "height":
+				height = attr[2]
+			}
+		}
+		return width, height
+	}
+	if cfg, err := png.DecodeConfig(bytes.NewReader(data)); err == nil {
+		return strconv.Itoa(cfg.Width), strconv.Itoa(cfg.Height)
+	}
+	return "", ""
+}
+
+// convert converts eq, described by desc, into an image, or reads
+// the image from CacheDir if it was converted before.
+func (r *renderer) convert(ctx context.Context, eq Equation, desc string) ([]byte, error) {
+	var cachePath string
+	if r.opts.CacheDir != "" {
+		cachePath = filepath.Join(r.opts.CacheDir, cacheKey(&eq, r.opts)+"."+r.opts.format())
+		if data, err := ioutil.ReadFile(cachePath); err == nil {
+			r.opts.logf(1, "%s: found in %s", desc, cachePath)
+			return data, nil
+		}
+	}
+	var buf bytes.Buffer
+	start := time.Now()
+	if err := r.opts.Converter.Convert(ctx, eq, &buf); err != nil {
+		return nil, fmt.Errorf("%s: %v", desc, err)
+	}
+	r.opts.logf(2, "%s: converted in %v", desc, time.Since(start))
+	if cachePath != "" {
+		if err := writeFileAtomic(cachePath, buf.Bytes()); err != nil {
+			return nil, err
+		}
+		if r.opts.CacheMiss != nil {
+			r.opts.CacheMiss(desc)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// path2x returns the path of the double resolution variant of the
+// image at path.
+func path2x(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "@2x" + ext
+}
+
+// srcset returns the srcset of an image referenced by ref, whose
+// double resolution variant is at path2x.
+func (r *renderer) srcset(ref, path2x string) (string, error) {
+	ref2x, err := r.imageRef(path2x)
+	if err != nil {
+		return "", err
+	}
+	return ref + " 1x, " + ref2x + " 2x", nil
+}
@@ -0,0 +1,929 @@
+package latex
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSVG returns the image fakeConverter generates for eq.
+func fakeSVG(eq Equation) string {
+	return fmt.Sprintf(`<svg style="vertical-align: -0.5ex" xmlns="http://www.w3.org/2000/svg" width="2ex" height="3ex" viewBox="0 -10 20 30"><text>%s</text></svg>`,
+		html.EscapeString(eq.Source))
+}
+
+// fakeConverter is a Converter that generates an SVG image containing
+// the equation's source.
+var fakeConverter = ConverterFunc(func(ctx context.Context, eq Equation, w io.Writer) error {
+	_, err := io.WriteString(w, fakeSVG(eq))
+	return err
+})
+
+// recordingConverter returns a Converter like fakeConverter that also
+// records each equation it converts in eqs.
+func recordingConverter(eqs *[]Equation) Converter {
+	var mu sync.Mutex
+	return ConverterFunc(func(ctx context.Context, eq Equation, w io.Writer) error {
+		mu.Lock()
+		*eqs = append(*eqs, eq)
+		mu.Unlock()
+		return fakeConverter(ctx, eq, w)
+	})
+}
+
+// tempDir returns a new temporary directory, removed at the end of
+// the test.
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "latex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// render renders the document in with opts, generating images to a
+// new temporary directory unless opts.ImgDir is set, with fakeConverter
+// unless opts.Converter is set. It returns the rendered document and
+// the image directory.
+func render(t *testing.T, opts Options, in string) (string, string) {
+	t.Helper()
+	if opts.ImgDir == "" {
+		opts.ImgDir = tempDir(t)
+	}
+	if opts.Converter == nil {
+		opts.Converter = fakeConverter
+	}
+	var out bytes.Buffer
+	if err := Render(strings.NewReader(in), &out, opts); err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	return out.String(), opts.ImgDir
+}
+
+// readFile returns the contents of the file at path.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// files returns the names of the files in dir.
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+const doc = "Inline `$x^2$` and `$y$`.\n" +
+	"\n" +
+	"```render-latex\n" +
+	"E = mc^2\n" +
+	"```\n"
+
+var renderTests = []struct {
+	name string
+	opts Options
+	in   string
+	want string
+}{
+	{
+		name: "default",
+		in:   doc,
+		want: "Inline ![`x^2`](inl1.svg) and ![`y`](inl2.svg).\n\n![Equation 1](eqn1.svg)\n",
+	},
+	{
+		name: "figure",
+		opts: Options{Figure: true},
+		in:   doc,
+		want: "Inline ![`x^2`](inl1.svg) and ![`y`](inl2.svg).\n\n" +
+			"<figure id=\"eqn-1\">\n<img src=\"eqn1.svg\" alt=\"Equation 1\">\n<figcaption>Equation 1</figcaption>\n</figure>\n",
+	},
+	{
+		name: "embed source",
+		opts: Options{EmbedSource: true},
+		in:   "a `$x--y$`\n\n```render-latex\na & b\n```\n",
+		want: "a ![`x--y`](inl1.svg)<!-- latex: x&#45;&#45;y -->\n\n" +
+			"<!-- latex:\na &amp; b\n-->\n![Equation 1](eqn1.svg)\n",
+	},
+	{
+		name: "html",
+		opts: Options{InlineHTML: true, BlockHTML: true},
+		in:   doc,
+		want: "Inline <img src=\"inl1.svg\" alt=\"`x^2`\"> and <img src=\"inl2.svg\" alt=\"`y`\">.\n\n" +
+			"<img src=\"eqn1.svg\" alt=\"Equation 1\">\n",
+	},
+	{
+		name: "native",
+		opts: Options{Native: true},
+		in:   doc,
+		want: "Inline $x^2$ and $y$.\n\n$$\nE = mc^2\n$$\n",
+	},
+	{
+		name: "sprite",
+		opts: Options{Sprite: true},
+		in:   "`$x$`\n",
+		want: "<svg role=\"img\" aria-label=\"`x`\" style=\"vertical-align: -0.5ex\" width=\"2ex\" height=\"3ex\"><use href=\"sprite.svg#inl1\"/></svg>\n",
+	},
+	{
+		name: "label",
+		opts: Options{EqnLabel: "Eq. {{.Chapter}}.{{.Num}}", Chapter: "3"},
+		in:   doc,
+		want: "Inline ![`x^2`](inl1.svg) and ![`y`](inl2.svg).\n\n![Eq. 3.1](eqn1.svg)\n",
+	},
+	{
+		name: "prefix",
+		opts: Options{Prefix: "ch1"},
+		in:   doc,
+		want: "Inline ![`x^2`](ch1-inl1.svg) and ![`y`](ch1-inl2.svg).\n\n![ch1 Equation 1](ch1-eqn1.svg)\n",
+	},
+	{
+		name: "rewrite base",
+		opts: Options{RewriteBase: [2]string{"", "https://cdn.example.com/"}},
+		in:   "`$x$`\n",
+		want: "![`x`](https://cdn.example.com/inl1.svg)\n",
+	},
+	{
+		name: "escape alt",
+		opts: Options{EscapeAlt: true, EqnLabel: "eq_{{.Num}}"},
+		in:   "```render-latex\nx\n```\n",
+		want: "![eq\\_1](eqn1.svg)\n",
+	},
+	{
+		name: "sourcemap",
+		opts: Options{SourceMap: true},
+		in:   "a `$x$`\n\n```render-latex\ny\n```\n",
+		want: "a <!-- src: line 1 -->![`x`](inl1.svg)\n\n<!-- src: lines 3-5 -->\n![Equation 1](eqn1.svg)\n",
+	},
+	{
+		name: "center",
+		opts: Options{Center: true},
+		in:   "```render-latex\ny\n```\n",
+		want: "<div align=\"center\">\n\n![Equation 1](eqn1.svg)\n\n</div>\n",
+	},
+	{
+		name: "inline delimiters",
+		opts: Options{InlineDelims: [2]string{`\(`, `\)`}},
+		in:   "a \\(x\\) and `$y$`\n",
+		want: "a ![`x`](inl1.svg) and `$y$`\n",
+	},
+	{
+		name: "number labeled",
+		opts: Options{NumberLabeled: true},
+		in:   "```render-latex\na\n```\n```render-latex\nb \\label{b}\n```\n",
+		want: "![`a`](eqn1.svg)\n![Equation 1](eqn2.svg)\n",
+	},
+	{
+		name: "code untouched",
+		in:   "```\n`$x$`\n```\n\n`` `$y$` ``\n",
+		want: "```\n`$x$`\n```\n\n`` `$y$` ``\n",
+	},
+	{
+		name: "table",
+		in:   "| `$|x|$` | `$y$` |\n",
+		want: "| ![`\\|x\\|`](inl1.svg) | ![`y`](inl2.svg) |\n",
+	},
+	{
+		name: "table html",
+		opts: Options{InlineHTML: true, EmbedSource: true},
+		in:   "| `$|x|$` |\n",
+		want: "| <img src=\"inl1.svg\" alt=\"`\\|x\\|`\"><!-- latex: \\|x\\| --> |\n",
+	},
+	{
+		name: "table without outer pipes",
+		in:   "a | b\n--|--\n`$x|y$` | c\n\n`$|z|$`\n",
+		want: "a | b\n--|--\n![`x\\|y`](inl1.svg) | c\n\n![`|z|`](inl2.svg)\n",
+	},
+	{
+		name: "valign",
+		opts: Options{VAlign: "-0.3ex"},
+		in:   "`$x$`\n",
+		want: "<img src=\"inl1.svg\" alt=\"`x`\" style=\"vertical-align: -0.3ex\">\n",
+	},
+	{
+		name: "valign auto",
+		opts: Options{VAlign: "auto"},
+		in:   "`$x$`\n",
+		want: "<img src=\"inl1.svg\" alt=\"`x`\" style=\"vertical-align: -0.5ex\">\n",
+	},
+	{
+		name: "templates",
+		opts: Options{
+			InlineTemplate: `<span class="math"><img src="{{.Ref}}" alt="{{html .Alt}}" width="{{.Width}}" height="{{.Height}}"></span>`,
+			BlockTemplate:  `<p id="eq{{.Num}}"><img src="{{.Ref}}" alt="{{.Alt}}"></p>`,
+		},
+		in: doc,
+		want: "Inline <span class=\"math\"><img src=\"inl1.svg\" alt=\"`x^2`\" width=\"2ex\" height=\"3ex\"></span> and " +
+			"<span class=\"math\"><img src=\"inl2.svg\" alt=\"`y`\" width=\"2ex\" height=\"3ex\"></span>.\n\n" +
+			"<p id=\"eq1\"><img src=\"eqn1.svg\" alt=\"Equation 1\"></p>\n",
+	},
+}
+
+func TestRender(t *testing.T) {
+	for _, tt := range renderTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := render(t, tt.opts, tt.in)
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderImages(t *testing.T) {
+	out, dir := render(t, Options{}, doc)
+	if strings.Contains(out, "render-latex") {
+		t.Errorf("output still contains a render-latex block:\n%s", out)
+	}
+	for name, src := range map[string]string{"inl1.svg": "x^2", "inl2.svg": "y", "eqn1.svg": "E = mc^2\n"} {
+		if got, want := readFile(t, filepath.Join(dir, name)), fakeSVG(Equation{Source: src}); got != want {
+			t.Errorf("%s holds %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestConverterEquations(t *testing.T) {
+	var eqs []Equation
+	render(t, Options{Converter: recordingConverter(&eqs)}, "`$a$`\n\n```render-latex {scale=1.5 color=blue bogus=1}\nb\n```\n")
+	want := []Equation{
+		{Source: "a", Inline: true},
+		{Source: "b\n", Attrs: map[string]string{"scale": "1.5", "color": "blue"}},
+	}
+	if fmt.Sprint(eqs) != fmt.Sprint(want) {
+		t.Errorf("converted %v, want %v", eqs, want)
+	}
+}
+
+func TestDPIAttr(t *testing.T) {
+	var eqs []Equation
+	dir := tempDir(t)
+	script := filepath.Join(dir, "tex2png")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nprintf '%s\\n' \"$@\" >> \"$(dirname \"$0\")/args\"\n"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	cvt := &ExecConverter{Path: script, Format: "png", DPI: 150}
+	render(t, Options{Format: "png", Converter: ConverterFunc(func(ctx context.Context, eq Equation, w io.Writer) error {
+		eqs = append(eqs, eq)
+		return cvt.Convert(ctx, eq, w)
+	})}, "```render-latex {dpi=300}\na\n```\n```render-latex\nb\n```\n")
+	if len(eqs) != 2 || eqs[0].Attrs["dpi"] != "300" {
+		t.Errorf("converted %v, want the first at 300 dpi", eqs)
+	}
+	want := "--inline=false\n--format=png\n--dpi=300\na\n\n--inline=false\n--format=png\n--dpi=150\nb\n\n"
+	if got := readFile(t, filepath.Join(dir, "args")); got != want {
+		t.Errorf("got arguments\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUnknownAttrWarning(t *testing.T) {
+	var log bytes.Buffer
+	render(t, Options{Log: &log}, "```render-latex {bogus=1}\nb\n```\n")
+	if !strings.Contains(log.String(), `line 1: warning: ignoring unknown render-latex attribute "bogus"`) {
+		t.Errorf("got log %q, want a warning about the unknown attribute", log.String())
+	}
+}
+
+func TestCache(t *testing.T) {
+	var eqs []Equation
+	out, dir := render(t, Options{Converter: recordingConverter(&eqs)},
+		"`$x$` `$x$`\n\n```render-latex\nx\n```\n```render-latex\nx\n```\n")
+	if want := "![`x`](inl1.svg) ![`x`](inl1.svg)\n\n![Equation 1](eqn1.svg)\n![Equation 2](eqn1.svg)\n"; out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+	if len(eqs) != 2 {
+		t.Errorf("converted %d equations, want 2: %v", len(eqs), eqs)
+	}
+	if got := files(t, dir); len(got) != 2 {
+		t.Errorf("generated %v, want one inline and one block image", got)
+	}
+}
+
+func TestNoInlineCache(t *testing.T) {
+	var eqs []Equation
+	out, _ := render(t, Options{Converter: recordingConverter(&eqs), NoInlineCache: true},
+		"`$x$` `$x$`\n\n```render-latex\nx\n```\n```render-latex\nx\n```\n")
+	if want := "![`x`](inl1.svg) ![`x`](inl2.svg)\n\n![Equation 1](eqn1.svg)\n![Equation 2](eqn1.svg)\n"; out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+	if len(eqs) != 3 {
+		t.Errorf("converted %d equations, want 3", len(eqs))
+	}
+}
+
+func TestSharedCache(t *testing.T) {
+	var eqs []Equation
+	dir := tempDir(t)
+	cache := NewCache()
+	for i, prefix := range []string{"a", "b"} {
+		outDir := filepath.Join(dir, prefix)
+		out, _ := render(t, Options{ImgDir: dir, OutDir: outDir, Prefix: prefix, Cache: cache, Converter: recordingConverter(&eqs)}, "`$x$`\n")
+		if want := "![`x`](../a-inl1.svg)\n"; out != want {
+			t.Errorf("document %d: got %q, want %q", i, out, want)
+		}
+	}
+	if len(eqs) != 1 {
+		t.Errorf("converted %d equations, want 1", len(eqs))
+	}
+}
+
+func TestCacheDir(t *testing.T) {
+	cacheDir := tempDir(t)
+	var eqs []Equation
+	var misses []string
+	opts := Options{CacheDir: cacheDir, Converter: recordingConverter(&eqs), CacheMiss: func(desc string) {
+		misses = append(misses, desc)
+	}}
+	first, dir := render(t, opts, doc)
+	if len(eqs) != 3 || len(misses) != 3 {
+		t.Fatalf("first render converted %v and missed %q, want all 3 equations", eqs, misses)
+	}
+	if got := files(t, cacheDir); len(got) != 3 {
+		t.Errorf("cache holds %v, want 3 images", got)
+	}
+
+	eqs, misses = nil, nil
+	second, dir2 := render(t, opts, doc+"\n`$z$`\n")
+	if want := first + "\n![`z`](inl3.svg)\n"; second != want {
+		t.Errorf("second render got\n%s\nwant\n%s", second, want)
+	}
+	if len(eqs) != 1 || len(misses) != 1 {
+		t.Errorf("second render converted %v and missed %q, want only z", eqs, misses)
+	}
+	for _, name := range files(t, dir) {
+		if got, want := readFile(t, filepath.Join(dir2, name)), readFile(t, filepath.Join(dir, name)); got != want {
+			t.Errorf("%s from the cache holds %s, want %s", name, got, want)
+		}
+	}
+
+	// Different options make for different images.
+	eqs, misses = nil, nil
+	opts.Background = "white"
+	render(t, opts, "`$x^2$`\n")
+	if len(eqs) != 1 || len(misses) != 1 {
+		t.Errorf("render with another background converted %v, want x^2 again", eqs)
+	}
+
+	// Failed conversions aren't cached.
+	misses = nil
+	opts.ImgDir = tempDir(t)
+	opts.Converter = ConverterFunc(func(ctx context.Context, eq Equation, w io.Writer) error {
+		return fmt.Errorf("failed")
+	})
+	if err := Render(strings.NewReader("`$w$`\n"), ioutil.Discard, opts); err == nil {
+		t.Errorf("render with a failing converter succeeded")
+	}
+	if len(misses) != 0 || len(files(t, cacheDir)) != 5 {
+		t.Errorf("failed conversion was cached")
+	}
+}
+
+// keyedConverter is a Converter with a CacheKey.
+type keyedConverter struct {
+	Converter
+	key string
+}
+
+func (c keyedConverter) CacheKey() string { return c.key }
+
+func TestConverterCacheKey(t *testing.T) {
+	cacheDir := tempDir(t)
+	var eqs []Equation
+	for i, key := range []string{"a", "b", "a"} {
+		cvt := keyedConverter{recordingConverter(&eqs), key}
+		render(t, Options{CacheDir: cacheDir, Converter: cvt}, "`$x$`\n")
+		if want := []int{1, 2, 2}[i]; len(eqs) != want {
+			t.Errorf("after rendering with key %q, converted %d equations, want %d", key, len(eqs), want)
+		}
+	}
+
+	// Each setting of the converters makes for a different key.
+	keys := make(map[string]bool)
+	for _, c := range []interface{ CacheKey() string }{
+		&ExecConverter{},
+		&ExecConverter{Path: "/bin/tex2svg"},
+		&ExecConverter{Format: "png"},
+		&ExecConverter{Format: "png", DPI: 192},
+		&ExecConverter{Packages: []string{"base"}},
+		&ExecConverter{Packages: []string{"base", "mhchem"}},
+		&ExecConverter{Dir: "doc"},
+		&WebPConverter{Converter: &ExecConverter{Format: "png"}},
+		&WebPConverter{Converter: &ExecConverter{Format: "png"}, Path: "/bin/cwebp"},
+	} {
+		key := c.CacheKey()
+		if keys[key] {
+			t.Errorf("%+v has the same cache key as another converter, %q", c, key)
+		}
+		keys[key] = true
+	}
+}
+
+func TestConcurrentRender(t *testing.T) {
+	var wg sync.WaitGroup
+	outs := make([]string, 4)
+	for i := range outs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var out bytes.Buffer
+			err := Render(strings.NewReader(doc), &out, Options{ImgDir: tempDir(t), Converter: fakeConverter})
+			if err != nil {
+				t.Error(err)
+			}
+			outs[i] = out.String()
+		}(i)
+	}
+	wg.Wait()
+	for i, out := range outs {
+		if out != outs[0] {
+			t.Errorf("render %d: got\n%s\nwant\n%s", i, out, outs[0])
+		}
+	}
+}
+
+func TestUnterminatedBlock(t *testing.T) {
+	err := Render(strings.NewReader("a\n```render-latex\nx\n"), ioutil.Discard, Options{ImgDir: tempDir(t), Converter: fakeConverter})
+	if err == nil || err.Error() != "line 2: unterminated render-latex block" {
+		t.Errorf("got error %v, want an unterminated block on line 2", err)
+	}
+}
+
+func TestConverterError(t *testing.T) {
+	dir := tempDir(t)
+	bad := ConverterFunc(func(ctx context.Context, eq Equation, w io.Writer) error {
+		io.WriteString(w, "<svg partial")
+		return fmt.Errorf("bad equation")
+	})
+	err := Render(strings.NewReader("`$x$`\n"), ioutil.Discard, Options{ImgDir: dir, Converter: bad})
+	if err == nil || !strings.Contains(err.Error(), "bad equation") {
+		t.Errorf("got error %v, want the converter's", err)
+	}
+	// Nothing is left behind, not even a partial image.
+	if got := files(t, dir); len(got) != 0 {
+		t.Errorf("left files %v behind", got)
+	}
+}
+
+func TestKeepTeX(t *testing.T) {
+	_, dir := render(t, Options{KeepTeX: true, Preamble: `\newcommand{\R}{\mathbb{R}}`}, "`$\\R$`\n")
+	if got, want := readFile(t, filepath.Join(dir, "inl1.tex")), "\\newcommand{\\R}{\\mathbb{R}}\n\\R"; got != want {
+		t.Errorf("inl1.tex holds %q, want %q", got, want)
+	}
+}
+
+func TestPreambleInCacheKey(t *testing.T) {
+	var eqs []Equation
+	cache := NewCache()
+	dir := tempDir(t)
+	render(t, Options{ImgDir: dir, Cache: cache, Converter: recordingConverter(&eqs)}, "`$x$`\n")
+	render(t, Options{ImgDir: dir, Cache: cache, Converter: recordingConverter(&eqs), Preamble: "% macros"}, "`$x$`\n")
+	if len(eqs) != 2 || eqs[1].Source != "% macros\nx" {
+		t.Errorf("converted %v, want x without and with the preamble", eqs)
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	var log bytes.Buffer
+	render(t, Options{Log: &log, Verbosity: 1}, "`$x$` `$x$`\n")
+	for _, want := range []string{`inline equation "x": cache miss, rendering to`, `inline equation "x": cache hit, using inl1.svg`} {
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("log %q doesn't contain %q", log.String(), want)
+		}
+	}
+	if strings.Contains(log.String(), "converted in") {
+		t.Errorf("log %q has timing at verbosity 1", log.String())
+	}
+}
+
+func TestFormatMismatchWarning(t *testing.T) {
+	var log bytes.Buffer
+	render(t, Options{Format: "png", Log: &log}, "`$x$`\n")
+	if !strings.Contains(log.String(), "converter produced svg, but") {
+		t.Errorf("got log %q, want a warning about the format", log.String())
+	}
+}
+
+func TestBackground(t *testing.T) {
+	withRect := ConverterFunc(func(ctx context.Context, eq Equation, w io.Writer) error {
+		_, err := io.WriteString(w, `<svg viewBox="0 -5 10 20"><rect width="100%" height="100%" fill="black"/><text>x</text></svg>`)
+		return err
+	})
+	for bg, want := range map[string]string{
+		"white":       `<svg viewBox="0 -5 10 20"><rect x="0" y="-5" width="10" height="20" fill="white"/><text>x</text></svg>`,
+		"transparent": `<svg viewBox="0 -5 10 20"><text>x</text></svg>`,
+	} {
+		_, dir := render(t, Options{Background: bg, Converter: withRect}, "`$x$`\n")
+		if got := readFile(t, filepath.Join(dir, "inl1.svg")); got != want {
+			t.Errorf("background %s: got %s, want %s", bg, got, want)
+		}
+	}
+	err := Render(strings.NewReader(""), ioutil.Discard, Options{Background: "white", Format: "png", Converter: fakeConverter})
+	if err == nil {
+		t.Errorf("setting the background of png images succeeded")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var got []string
+	render(t, Options{Progress: func(done, total int) {
+		got = append(got, fmt.Sprintf("%d/%d", done, total))
+	}}, doc+"```\n`$not counted$`\n```\n")
+	if want := []string{"1/3", "2/3", "3/3"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got progress %v, want %v", got, want)
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	dir := tempDir(t)
+	render(t, Options{ImgDir: dir}, "`$x$`\n")
+	path := filepath.Join(dir, "inl1.svg")
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	render(t, Options{ImgDir: dir, SkipUnchanged: true}, "`$x$`\n")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(old) {
+		t.Errorf("unchanged image was rewritten")
+	}
+	render(t, Options{ImgDir: dir}, "`$x$`\n")
+	if fi, err := os.Stat(path); err != nil || fi.ModTime().Equal(old) {
+		t.Errorf("image wasn't rewritten without SkipUnchanged")
+	}
+}
+
+func TestCreated(t *testing.T) {
+	var created []string
+	render(t, Options{Created: func(path string) {
+		created = append(created, filepath.Base(path))
+	}}, doc)
+	if want := []string{"inl1.svg", "inl2.svg", "eqn1.svg"}; fmt.Sprint(created) != fmt.Sprint(want) {
+		t.Errorf("created %v, want %v", created, want)
+	}
+}
+
+func TestIsGeneratedName(t *testing.T) {
+	for _, tt := range []struct {
+		prefix, name string
+		want         bool
+	}{
+		{"", "eqn1.svg", true},
+		{"", "inl12.png", true},
+		{"", "eqn1@2x.png", true},
+		{"", "logo.svg", false},
+		{"ch1", "ch1-eqn1.svg", true},
+		{"ch1", "eqn1.svg", false},
+		{"ch1", "ch2-eqn1.svg", false},
+	} {
+		if got := IsGeneratedName(tt.prefix, tt.name); got != tt.want {
+			t.Errorf("IsGeneratedName(%q, %q) = %t, want %t", tt.prefix, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSpecialImgDir(t *testing.T) {
+	dir := filepath.Join(tempDir(t), "my images#1")
+	if err := os.Mkdir(dir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := render(t, Options{ImgDir: dir, OutDir: filepath.Dir(dir)}, "`$x$`\n")
+	if want := "![`x`](my%20images%231/inl1.svg)\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestInlineDataURI(t *testing.T) {
+	out, dir := render(t, Options{InlineDataURI: true}, "`$x$`\n\n```render-latex\ny\n```\n")
+	if !strings.HasPrefix(out, "![`x`](data:image/svg+xml;base64,") {
+		t.Errorf("got %q, want a data URI", out)
+	}
+	if got := files(t, dir); fmt.Sprint(got) != "[eqn1.svg]" {
+		t.Errorf("generated %v, want only the block equation's image", got)
+	}
+}
+
+func TestOutName(t *testing.T) {
+	out, dir := render(t, Options{}, "```render-latex {out=energy}\nE\n```\n")
+	if want := "![Equation 1](energy.svg)\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+	if got := files(t, dir); fmt.Sprint(got) != "[energy.svg]" {
+		t.Errorf("generated %v, want energy.svg", got)
+	}
+	for _, in := range []string{
+		"```render-latex {out=eqn1.svg}\nE\n```\n",
+		"```render-latex {out=a/b}\nE\n```\n",
+		"```render-latex {out=a.png}\nE\n```\n",
+		"```render-latex {out=a}\nE\n```\n```render-latex {out=a}\nF\n```\n",
+	} {
+		if err := Render(strings.NewReader(in), ioutil.Discard, Options{ImgDir: tempDir(t), Converter: fakeConverter}); err == nil {
+			t.Errorf("rendering %q succeeded", in)
+		}
+	}
+}
+
+func TestRenderIdempotent(t *testing.T) {
+	out, _ := render(t, Options{EmbedSource: true}, doc)
+	again, _ := render(t, Options{EmbedSource: true}, out)
+	if again != out {
+		t.Errorf("rendering again changed\n%s\nto\n%s", out, again)
+	}
+}
+
+func TestMaxEquationBytes(t *testing.T) {
+	err := Render(strings.NewReader("```render-latex\n0123456789\n```\n"), ioutil.Discard,
+		Options{ImgDir: tempDir(t), Converter: fakeConverter, MaxEquationBytes: 10})
+	if err == nil || !strings.Contains(err.Error(), "more than the limit of 10") {
+		t.Errorf("got error %v, want one about the limit", err)
+	}
+}
+
+func TestSrcset(t *testing.T) {
+	var eqs []Equation
+	withDPI := ConverterFunc(func(ctx context.Context, eq Equation, w io.Writer) error {
+		eqs = append(eqs, eq)
+		_, err := fmt.Fprintf(w, "%s at %s dpi", eq.Source, eq.Attrs["dpi"])
+		return err
+	})
+	out, dir := render(t, Options{Format: "png", DPI: 100, Srcset: true, Converter: withDPI}, "`$x$`\n")
+	if want := "<img src=\"inl1.png\" srcset=\"inl1.png 1x, inl1@2x.png 2x\" alt=\"`x`\">\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+	if got := files(t, dir); fmt.Sprint(got) != "[inl1.png inl1@2x.png]" {
+		t.Errorf("generated %v, want inl1.png and inl1@2x.png", got)
+	}
+	if len(eqs) != 2 || eqs[1].Attrs["dpi"] != "200" {
+		t.Errorf("converted %v, want the 2x image at 200 dpi", eqs)
+	}
+	if err := Render(strings.NewReader(""), ioutil.Discard, Options{Srcset: true, Converter: fakeConverter}); err == nil {
+		t.Errorf("srcset with svg images succeeded")
+	}
+	err := Render(strings.NewReader("`$x$`\n"), ioutil.Discard, Options{ImgDir: tempDir(t), Format: "png", Srcset: true, Converter: fakeConverter})
+	if err == nil || !strings.Contains(err.Error(), "ignored the dpi attribute") {
+		t.Errorf("got error %v from a converter ignoring dpi, want one about srcset", err)
+	}
+}
+
+func TestSprite(t *testing.T) {
+	var eqs []Equation
+	_, dir := render(t, Options{Sprite: true, Converter: recordingConverter(&eqs)},
+		"`$x$` `$y$` `$x$`\n\n```render-latex\nz\n```\n")
+	if got := files(t, dir); fmt.Sprint(got) != "[sprite.svg]" {
+		t.Errorf("generated %v, want just sprite.svg", got)
+	}
+	sprite := readFile(t, filepath.Join(dir, "sprite.svg"))
+	if n := strings.Count(sprite, "<symbol "); n != 3 || len(eqs) != 3 {
+		t.Errorf("sprite holds %d symbols from %d conversions, want one for each of x, y, and z:\n%s", n, len(eqs), sprite)
+	}
+
+	eqs = nil
+	err := Render(strings.NewReader("`$x$`\n"), ioutil.Discard, Options{ImgDir: tempDir(t), Format: "png", Sprite: true, Converter: recordingConverter(&eqs)})
+	if err == nil || len(eqs) != 0 {
+		t.Errorf("sprite of png images converted %v and returned error %v, want an error up front", eqs, err)
+	}
+}
+
+func TestBadVAlign(t *testing.T) {
+	if err := Render(strings.NewReader(""), ioutil.Discard, Options{VAlign: "1; color: red", Converter: fakeConverter}); err == nil {
+		t.Errorf("rendering with an invalid vertical alignment succeeded")
+	}
+}
+
+func TestStrip(t *testing.T) {
+	for _, opts := range []Options{
+		{EmbedSource: true},
+		{EmbedSource: true, InlineHTML: true, BlockHTML: true, SourceMap: true},
+		{EmbedSource: true, Figure: true, Center: true},
+		{EmbedSource: true, Sprite: true, EscapeAlt: true},
+	} {
+		src := "Inline `$x_1$` and `$a--b$` in text.\n" +
+			"\n" +
+			"| `$|x|$` | b |\n" +
+			"\n" +
+			"a | b\n" +
+			"--|--\n" +
+			"`$\\|x\\|$` | `$y|z$`\n" +
+			"\n" +
+			"Norm `$\\|x\\|$`.\n" +
+			"\n" +
+			"```render-latex {out=energy color=red bogus=1 scale=2}\n" +
+			"E = mc^2\n" +
+			"```\n" +
+			"\n" +
+			"```render-latex\tcolor=--blue\n" +
+			"F = ma\n" +
+			"```\n"
+		rendered, _ := render(t, opts, src)
+		var out bytes.Buffer
+		if err := Strip(strings.NewReader(rendered), &out, Options{}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != src {
+			t.Errorf("%+v: stripping\n%s\ngot\n%s\nwant\n%s", opts, rendered, out.String(), src)
+		}
+	}
+}
+
+func TestExecConverter(t *testing.T) {
+	dir := tempDir(t)
+	script := filepath.Join(dir, "tex2svg")
+	// The script echoes its working directory and arguments.
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\npwd\nprintf '%s\\n' \"$@\"\n"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	c := &ExecConverter{Path: script, Packages: []string{"base", "mhchem"}, Dir: dir}
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err := c.Convert(context.Background(), Equation{Source: `\ce{H2O}`, Inline: true, Attrs: map[string]string{"scale": "2"}}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dir + "\n--inline=true\n--packages=base,mhchem\n--scale=2\n\\ce{H2O}\n"
+	if got := out.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestExecConverterStderr(t *testing.T) {
+	dir := tempDir(t)
+	script := filepath.Join(dir, "tex2svg")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho 'TeX error' >&2\nexit 1\n"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	err := (&ExecConverter{Path: script}).Convert(context.Background(), Equation{Source: "x"}, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "TeX error") {
+		t.Errorf("got error %v, want the converter's stderr", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := tempDir(t)
+	notExec := filepath.Join(dir, "tex2svg")
+	if err := ioutil.WriteFile(notExec, nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "missing"), notExec, "no-such-tex2svg-in-path"} {
+		if err := (&ExecConverter{Path: path}).Check(); err == nil {
+			t.Errorf("checking %s succeeded", path)
+		}
+	}
+}
+
+func TestCheckFormat(t *testing.T) {
+	dir := tempDir(t)
+	script := filepath.Join(dir, "tex2svg")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+	for _, tt := range []struct {
+		format string
+		ok     bool
+	}{
+		{"", true},
+		{"svg", true},
+		{"png", false},
+		{"pdf", false},
+		{"gif", false},
+	} {
+		if err := (&ExecConverter{Path: script, Format: tt.format}).Check(); (err == nil) != tt.ok {
+			t.Errorf("checking format %q without rsvg-convert: got error %v", tt.format, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "rsvg-convert"), []byte("#!/bin/sh\n"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{"png", "pdf"} {
+		if err := (&ExecConverter{Path: script, Format: format}).Check(); err != nil {
+			t.Errorf("checking format %q with rsvg-convert: %v", format, err)
+		}
+	}
+	// Other utilities are trusted with any format.
+	other := filepath.Join(dir, "tex2gif")
+	if err := ioutil.WriteFile(other, []byte("#!/bin/sh\n"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&ExecConverter{Path: other, Format: "gif"}).Check(); err != nil {
+		t.Errorf("checking format gif of %s: %v", other, err)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if err := SelfTest(context.Background(), fakeConverter, ""); err != nil {
+		t.Errorf("self test with a working converter failed: %v", err)
+	}
+	if err := SelfTest(context.Background(), fakeConverter, "png"); err == nil || !strings.Contains(err.Error(), "svg image, not png") {
+		t.Errorf("got error %v from a converter producing svg instead of png, want one about the format", err)
+	}
+	png := ConverterFunc(func(ctx context.Context, eq Equation, w io.Writer) error {
+		_, err := io.WriteString(w, "\x89PNG\r\n\x1a\n")
+		return err
+	})
+	if err := SelfTest(context.Background(), png, "png"); err != nil {
+		t.Errorf("self test with a converter producing png failed: %v", err)
+	}
+	broken := ConverterFunc(func(ctx context.Context, eq Equation, w io.Writer) error {
+		return fmt.Errorf("tex2svg: command not found")
+	})
+	if err := SelfTest(context.Background(), broken, ""); err == nil || !strings.Contains(err.Error(), "command not found") {
+		t.Errorf("got error %v from a broken converter, want its error", err)
+	}
+	for _, output := range []string{"garbage", "<svg><text>truncated"} {
+		garbage := ConverterFunc(func(ctx context.Context, eq Equation, w io.Writer) error {
+			_, err := io.WriteString(w, output)
+			return err
+		})
+		if err := SelfTest(context.Background(), garbage, "svg"); err == nil {
+			t.Errorf("self test with a converter producing %q succeeded", output)
+		}
+	}
+}
+
+func TestWebPConverter(t *testing.T) {
+	dir := tempDir(t)
+	// The stub cwebp copies its input, prefixed with a WebP header.
+	cwebp := filepath.Join(dir, "cwebp")
+	stub := "#!/bin/sh\n{ printf 'RIFF\\0\\0\\0\\0WEBP'; cat \"$2\"; } > \"$4\"\n"
+	if err := ioutil.WriteFile(cwebp, []byte(stub), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	var eqs []Equation
+	c := &WebPConverter{Converter: recordingConverter(&eqs), Path: cwebp}
+	var out bytes.Buffer
+	if err := c.Convert(context.Background(), Equation{Source: "x"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "RIFF\x00\x00\x00\x00WEBP" + fakeSVG(Equation{Source: "x"}); out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+	if got := sniffFormat(out.Bytes()); got != "webp" {
+		t.Errorf("output sniffed as %q, want webp", got)
+	}
+}
+
+func TestWebPExecConverter(t *testing.T) {
+	dir := tempDir(t)
+	// The stub tex2svg only produces PNG images when asked to.
+	script := filepath.Join(dir, "tex2svg")
+	stub := "#!/bin/sh\n[ \"$2\" = --format=png ] || { echo \"unexpected $2\" >&2; exit 1; }\nprintf '\\211PNG\\r\\n\\032\\n'\n"
+	if err := ioutil.WriteFile(script, []byte(stub), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cwebp", "rsvg-convert"} {
+		stub := "#!/bin/sh\n{ printf 'RIFF\\0\\0\\0\\0WEBP'; cat \"$2\"; } > \"$4\"\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(stub), 0o777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	c := &WebPConverter{Converter: &ExecConverter{Path: script, Format: "png"}}
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := c.Convert(context.Background(), Equation{Source: "x"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "RIFF\x00\x00\x00\x00WEBP\x89PNG\r\n\x1a\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	c.Converter = &ExecConverter{Path: script, Format: "webp"}
+	if err := c.Check(); err == nil {
+		t.Errorf("checking a converter producing webp images succeeded")
+	}
+	c.Converter, c.Path = &ExecConverter{Path: script, Format: "png"}, filepath.Join(dir, "missing")
+	if err := c.Check(); err == nil {
+		t.Errorf("checking a missing cwebp succeeded")
+	}
+	if err := (&ExecConverter{Path: script, Format: "webp"}).Check(); err == nil || !strings.Contains(err.Error(), "cwebp") {
+		t.Errorf("got error %v checking tex2svg for webp images, want one suggesting cwebp", err)
+	}
+}
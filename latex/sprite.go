@@ -0,0 +1,68 @@
+package latex
+
+import (
+	"fmt"
+	"html"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// spriteName is the name of the sprite file generated in sprite mode.
+const spriteName = "sprite.svg"
+
+var (
+	svgRootExp = regexp.MustCompile(`(?s)^\s*(?:<\?xml[^>]*\?>\s*)?<svg([^>]*)>(.*)</svg>\s*$`)
+	svgAttrExp = regexp.MustCompile(`([A-Za-z][A-Za-z:-]*)="([^"]*)"`)
+)
+
+// symbol is an image in a sprite.
+type symbol struct {
+	id      string
+	viewBox string
+	body    string
+}
+
+// addSymbol adds the SVG image data to the sprite as a symbol named id.
+// It returns the attributes of the image's root element that determine
+// how it's displayed, for use where the symbol is referenced.
+func (r *renderer) addSymbol(id string, data []byte) (string, error) {
+	m := svgRootExp.FindSubmatch(data)
+	if m == nil {
+		return "", fmt.Errorf("converter output is not an SVG image")
+	}
+	sym := symbol{id: id}
+	var display strings.Builder
+	for _, attr := range svgAttrExp.FindAllStringSubmatch(string(m[1]), -1) {
+		switch attr[1] {
+		case "viewBox":
+			sym.viewBox = attr[2]
+		case "width", "height", "style":
+			fmt.Fprintf(&display, " %s=\"%s\"", attr[1], attr[2])
+		}
+	}
+	// Every image defines its own IDs, so namespace them by symbol
+	// to avoid collisions within the sprite.
+	sym.body = strings.NewReplacer(
+		`id="`, `id="`+id+`-`,
+		`href="#`, `href="#`+id+`-`,
+	).Replace(string(m[2]))
+	r.symbols = append(r.symbols, sym)
+	return display.String(), nil
+}
+
+// spritePath returns the path of the sprite file.
+func (r *renderer) spritePath() string {
+	return filepath.Join(r.opts.ImgDir, r.opts.fileName(spriteName))
+}
+
+// writeSprite writes out all the symbols added to the sprite.
+func (r *renderer) writeSprite() error {
+	var b strings.Builder
+	b.WriteString(`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" style="display: none">` + "\n")
+	for _, sym := range r.symbols {
+		fmt.Fprintf(&b, "<symbol id=\"%s\" viewBox=\"%s\">%s</symbol>\n", sym.id, html.EscapeString(sym.viewBox), sym.body)
+	}
+	b.WriteString("</svg>\n")
+	return r.writeFile(r.spritePath(), []byte(b.String()))
+}
@@ -0,0 +1,160 @@
+package latex
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// sourceUnescaper reverses sourceEscaper.
+var sourceUnescaper = strings.NewReplacer("&#45;&#45;", "--", "&amp;", "&")
+
+var (
+	blockSourceExp = regexp.MustCompile(`^<!-- latex([ \t{].*)?:$`)
+	srcLinesExp    = regexp.MustCompile(`^<!-- src: lines [0-9]+-[0-9]+ -->$`)
+	srcLineExp     = regexp.MustCompile(`<!-- src: line [0-9]+ -->$`)
+)
+
+// Strip reads a markdown document rendered by Render with EmbedSource
+// set from in, and writes it to out with each equation image reference
+// replaced by the LaTeX it was generated from, undoing Render. Image
+// references without embedded source are left alone. Only the
+// InlineDelims option is used, to write inline equations.
+func Strip(in io.Reader, out io.Writer, opts Options) error {
+	open, close := opts.inlineDelims()
+	s := newLineReader(in)
+	var tables tableTracker
+	lineNum := 0
+	// srcMap is a source map comment that may belong to the block
+	// equation following it.
+	srcMap := ""
+	flush := func() {
+		if srcMap != "" {
+			fmt.Fprintln(out, srcMap)
+			srcMap = ""
+		}
+	}
+	for s.Scan() {
+		lineNum++
+		line := s.Text()
+		if srcLinesExp.MatchString(line) {
+			// Hold on to a source map comment until we know whether
+			// it belongs to an equation.
+			flush()
+			srcMap = line
+			continue
+		}
+		m := blockSourceExp.FindStringSubmatch(line)
+		if m == nil {
+			flush()
+			fmt.Fprintln(out, stripInline(line, open, close, tables.row(line, s.Peek())))
+			continue
+		}
+		srcMap = ""
+
+		// The comment holds the source, followed by the reference.
+		start := lineNum
+		var src strings.Builder
+		for {
+			if !s.Scan() {
+				return fmt.Errorf("line %d: unterminated latex source comment", start)
+			}
+			lineNum++
+			line := s.Text()
+			if strings.HasSuffix(line, "-->") {
+				src.WriteString(strings.TrimSuffix(line, "-->"))
+				break
+			}
+			src.WriteString(line)
+			src.WriteString("\n")
+		}
+		if !s.Scan() {
+			return fmt.Errorf("line %d: latex source comment isn't followed by an image reference", start)
+		}
+		lineNum++
+		ref := strings.TrimSpace(s.Text())
+		if end := refEnd(ref); end != "" {
+			// The reference spans several lines.
+			for ref != end {
+				if !s.Scan() {
+					return fmt.Errorf("line %d: unterminated image reference", start)
+				}
+				lineNum++
+				ref = strings.TrimSpace(s.Text())
+			}
+		}
+		fmt.Fprintf(out, "```render-latex%s\n%s```\n", sourceUnescaper.Replace(m[1]), sourceUnescaper.Replace(src.String()))
+	}
+	flush()
+	return s.Err()
+}
+
+// refEnd returns the line ending the multi-line block equation
+// reference beginning with line, or the empty string if the reference
+// is just the one line.
+func refEnd(line string) string {
+	switch {
+	case strings.HasPrefix(line, "<div align=\"center\">"):
+		return "</div>"
+	case strings.HasPrefix(line, "<figure"):
+		return "</figure>"
+	}
+	return ""
+}
+
+// stripInline returns line with each inline equation image reference
+// that is followed by its embedded source replaced by the source,
+// delimited by open and close. If inTable is set, line is a row of a
+// pipe table, whose references and sources have their pipes escaped.
+func stripInline(line, open, close string, inTable bool) string {
+	const commentOpen, commentClose = "<!-- latex: ", " -->"
+	var b strings.Builder
+	for {
+		i := strings.Index(line, commentOpen)
+		if i < 0 {
+			break
+		}
+		j := strings.Index(line[i+len(commentOpen):], commentClose)
+		if j < 0 {
+			break
+		}
+		src := line[i+len(commentOpen) : i+len(commentOpen)+j]
+		if inTable {
+			src = pipeUnescaper.Replace(src)
+		}
+		src = sourceUnescaper.Replace(src)
+		before, rest := line[:i], line[i+len(commentOpen)+j+len(commentClose):]
+		if start := inlineRefStart(before, src); start >= 0 {
+			before = srcLineExp.ReplaceAllString(before[:start], "")
+			b.WriteString(before + open + src + close)
+		} else {
+			b.WriteString(line[:len(line)-len(rest)])
+		}
+		line = rest
+	}
+	b.WriteString(line)
+	return b.String()
+}
+
+// inlineRefStart returns the offset in s of the image reference to
+// the inline equation src that s ends with, or -1 if there isn't one.
+func inlineRefStart(s, src string) int {
+	switch {
+	case strings.HasSuffix(s, ")"):
+		alt := fmt.Sprintf("`%s`", src)
+		for _, alt := range []string{alt, escapeMarkdown(alt), strings.Replace(alt, "|", `\|`, -1), strings.Replace(escapeMarkdown(alt), "|", `\|`, -1)} {
+			i := strings.LastIndex(s, "!["+alt+"](")
+			if i >= 0 && !strings.ContainsAny(s[i+len(alt)+4:len(s)-1], " )") {
+				return i
+			}
+		}
+	case strings.HasSuffix(s, ">"):
+		i := strings.LastIndex(s, "<img ")
+		if strings.HasSuffix(s, "</svg>") {
+			i = strings.LastIndex(s, "<svg ")
+		}
+		return i
+	}
+	return -1
+}
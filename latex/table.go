@@ -0,0 +1,134 @@
+package latex
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// pipeEscaper escapes the pipes in an image reference or comment in a
+// row of a pipe table, which would otherwise end the cell it's in.
+// GitHub removes the backslashes before parsing the cell's contents,
+// so this works for markdown and HTML alike.
+var pipeEscaper = strings.NewReplacer("|", `\|`)
+
+// pipeUnescaper reverses pipeEscaper.
+var pipeUnescaper = strings.NewReplacer(`\|`, "|")
+
+// tableTracker recognizes the rows of pipe tables in a document, one
+// line at a time, the same way md-wrap does.
+type tableTracker struct {
+	inTable bool
+}
+
+// row reports whether line, which is followed by nextLine, is a row of
+// a pipe table.
+func (t *tableTracker) row(line, nextLine string) bool {
+	t.inTable = isTableRow(line, t.inTable) || !t.inTable && isTableHeader(line, nextLine)
+	return t.inTable
+}
+
+// trimQuote returns line without any leading quote markers and
+// surrounding whitespace.
+func trimQuote(line string) string {
+	line = strings.TrimSpace(line)
+	for strings.HasPrefix(line, ">") {
+		line = strings.TrimSpace(line[1:])
+	}
+	return line
+}
+
+// isTableRow reports whether line, less any quote prefix, is a row of
+// a pipe table. Outside of a table, only a line starting with a pipe is;
+// within one, so is any other line containing a pipe, since the outer
+// pipes of each row are optional.
+func isTableRow(line string, inTable bool) bool {
+	line = trimQuote(line)
+	if inTable {
+		return line != "" && countCells(line) > 1 || strings.HasPrefix(line, "|")
+	}
+	return strings.HasPrefix(line, "|")
+}
+
+// delimRowExp matches the delimiter row of a pipe table, like
+// "--- | :-:".
+var delimRowExp = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+
+// isTableHeader reports whether line, less any quote prefix, is the
+// header row of a pipe table, followed by its delimiter row in
+// nextLine, with the same number of cells.
+func isTableHeader(line, nextLine string) bool {
+	line, nextLine = trimQuote(line), trimQuote(nextLine)
+	if !delimRowExp.MatchString(nextLine) {
+		return false
+	}
+	// A line without unescaped pipes followed by "---" is a setext
+	// heading instead.
+	cells := countCells(line)
+	return (cells > 1 || strings.HasPrefix(line, "|")) && cells == countCells(nextLine)
+}
+
+// countCells returns the number of cells in a row of a pipe table. A
+// pipe escaped with a backslash doesn't separate cells.
+func countCells(row string) int {
+	row = strings.TrimPrefix(row, "|")
+	if strings.HasSuffix(row, "|") && !strings.HasSuffix(row, "\\|") {
+		row = row[:len(row)-1]
+	}
+	n := 1
+	for i := 0; i < len(row); i++ {
+		switch row[i] {
+		case '\\':
+			i++
+		case '|':
+			n++
+		}
+	}
+	return n
+}
+
+// lineReader reads the lines of a document like a bufio.Scanner, but
+// with a line of lookahead, to recognize the header row of a table
+// without outer pipes by the delimiter row following it.
+type lineReader struct {
+	s          *bufio.Scanner
+	line, next string
+	hasNext    bool
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	lr := &lineReader{s: bufio.NewScanner(r)}
+	if lr.hasNext = lr.s.Scan(); lr.hasNext {
+		lr.next = lr.s.Text()
+	}
+	return lr
+}
+
+// Scan advances to the next line, reporting whether there is one.
+func (lr *lineReader) Scan() bool {
+	if !lr.hasNext {
+		return false
+	}
+	lr.line, lr.next = lr.next, ""
+	if lr.hasNext = lr.s.Scan(); lr.hasNext {
+		lr.next = lr.s.Text()
+	}
+	return true
+}
+
+// Text returns the current line.
+func (lr *lineReader) Text() string {
+	return lr.line
+}
+
+// Peek returns the line following the current one, or the empty
+// string if there is none.
+func (lr *lineReader) Peek() string {
+	return lr.next
+}
+
+// Err returns the first error reading the document.
+func (lr *lineReader) Err() error {
+	return lr.s.Err()
+}